@@ -0,0 +1,218 @@
+package piping_server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminPipesPath lists pipes with GET and cancels a pipe with DELETE on adminPipesPath + "/" + <id>
+const adminPipesPath = "/pipes"
+
+type clientStatus struct {
+	Addr     string `json:"addr"`
+	Protocol string `json:"protocol"`
+}
+
+type pipeStatus struct {
+	// ID is the hex HMAC-SHA-256 of the path with the key of the process
+	ID string `json:"id"`
+	// NOTE: omitted if AdminHashPaths is true
+	Path            string `json:"path,omitempty"`
+	Broadcast       bool   `json:"broadcast"`
+	SenderConnected bool   `json:"sender_connected"`
+	Transferring    bool   `json:"transferring"`
+	// NOTE: true while waiting for the sender to resume the transfer
+	Suspended  bool  `json:"suspended"`
+	NReceivers int   `json:"n_receivers"`
+	Bytes      int64 `json:"bytes"`
+	// NOTE: -1 if unknown
+	TotalLength int64          `json:"total_length"`
+	CreatedAt   time.Time      `json:"created_at"`
+	StartedAt   *time.Time     `json:"started_at,omitempty"`
+	Sender      *clientStatus  `json:"sender,omitempty"`
+	Receivers   []clientStatus `json:"receivers"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// pipeID returns the ID of the path. The ID is stable only within the process not to be matched with a guessed path.
+func (s *PipingServer) pipeID(path string) string {
+	mac := hmac.New(sha256.New, s.pipeIDKey)
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newClientStatus(req *http.Request) clientStatus {
+	return clientStatus{Addr: req.RemoteAddr, Protocol: req.Proto}
+}
+
+func (s *PipingServer) pipeStatus(path string, pi *pipe) pipeStatus {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	status := pipeStatus{
+		ID:              s.pipeID(path),
+		SenderConnected: pi.isSenderConnected,
+		Transferring:    pi.isTransferring,
+		Suspended:       pi.suspendedTransfer != nil,
+		NReceivers:      pi.nReceivers,
+		TotalLength:     -1,
+		CreatedAt:       pi.createdAt,
+		Receivers:       []clientStatus{},
+	}
+	if !s.AdminHashPaths {
+		status.Path = path
+	}
+	if pi.senderReq != nil {
+		sender := newClientStatus(pi.senderReq)
+		status.Sender = &sender
+	}
+	if t := pi.transfer; t != nil {
+		status.Bytes = t.receiverWriter.progress.Load()
+		status.TotalLength = t.totalLength
+		status.StartedAt = &t.startedAt
+		for _, slot := range t.slots {
+			status.Receivers = append(status.Receivers, newClientStatus(slot.receiver.req))
+		}
+		return status
+	}
+	for _, rcv := range pi.receivers {
+		status.Receivers = append(status.Receivers, newClientStatus(rcv.req))
+	}
+	return status
+}
+
+func (s *PipingServer) broadcastStatus(path string, b *broadcast) pipeStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := pipeStatus{
+		ID:              s.pipeID(path),
+		Broadcast:       true,
+		SenderConnected: b.isSenderConnected,
+		Transferring:    b.isSenderConnected,
+		NReceivers:      len(b.receivers),
+		Bytes:           b.progress.Load(),
+		TotalLength:     -1,
+		CreatedAt:       b.createdAt,
+		Receivers:       []clientStatus{},
+	}
+	if !s.AdminHashPaths {
+		status.Path = path
+	}
+	if b.senderReq != nil {
+		sender := newClientStatus(b.senderReq)
+		status.Sender = &sender
+		status.TotalLength = b.info.TotalLength
+		status.StartedAt = &b.startedAt
+	}
+	for r := range b.receivers {
+		status.Receivers = append(status.Receivers, newClientStatus(r.req))
+	}
+	return status
+}
+
+// pipeStatuses returns the statuses of all pipes and broadcasts in order of creation
+func (s *PipingServer) pipeStatuses() []pipeStatus {
+	statuses := []pipeStatus{}
+	s.pathToPipe.Range(func(path string, pi *pipe) bool {
+		statuses = append(statuses, s.pipeStatus(path, pi))
+		return true
+	})
+	s.pathToBroadcast.Range(func(path string, b *broadcast) bool {
+		statuses = append(statuses, s.broadcastStatus(path, b))
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.Before(statuses[j].CreatedAt)
+	})
+	return statuses
+}
+
+// cancelPipe aborts the sender and receivers on the pipe or the broadcast with the ID. It returns false if no pipe has the ID.
+func (s *PipingServer) cancelPipe(id string) bool {
+	canceled := false
+	s.pathToPipe.Range(func(path string, pi *pipe) bool {
+		if s.pipeID(path) != id {
+			return true
+		}
+		pi.mu.Lock()
+		if !pi.isClosed {
+			// NOTE: New senders and receivers on the path use a new pipe
+			s.closeLocked(path, pi)
+			close(pi.canceledCh)
+			canceled = true
+		}
+		pi.mu.Unlock()
+		if canceled {
+			s.logger.Warn("pipe canceled", "path", path)
+		}
+		return false
+	})
+	s.pathToBroadcast.Range(func(path string, b *broadcast) bool {
+		if s.pipeID(path) != id {
+			return true
+		}
+		b.mu.Lock()
+		isCanceled := !b.isClosed
+		if isCanceled {
+			// NOTE: New senders and receivers on the path use a new broadcast
+			s.cancelBroadcastLocked(path, b)
+		}
+		b.mu.Unlock()
+		if isCanceled {
+			canceled = true
+			s.logger.Warn("broadcast canceled", "path", path)
+		}
+		return false
+	})
+	return canceled
+}
+
+func writeAdminJSON(resWriter http.ResponseWriter, statusCode int, v any) {
+	resWriter.Header().Set("Content-Type", "application/json")
+	resWriter.WriteHeader(statusCode)
+	json.NewEncoder(resWriter).Encode(v)
+}
+
+// AdminHandler returns the handler of the admin JSON API. It should be served on a listener separated from Handler().
+//
+//	GET    /pipes       lists active pipes
+//	DELETE /pipes/<id>  cancels the pipe
+func (s *PipingServer) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(resWriter http.ResponseWriter, req *http.Request) {
+		if _, ok := s.authenticate(s.AdminAuth, resWriter, req); !ok {
+			return
+		}
+		if req.URL.Path == adminPipesPath {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				writeAdminJSON(resWriter, 405, adminError{Error: "Unsupported method: " + req.Method})
+				return
+			}
+			writeAdminJSON(resWriter, 200, struct {
+				Pipes []pipeStatus `json:"pipes"`
+			}{Pipes: s.pipeStatuses()})
+			return
+		}
+		id, ok := strings.CutPrefix(req.URL.Path, adminPipesPath+"/")
+		if !ok {
+			writeAdminJSON(resWriter, 404, adminError{Error: "Not found"})
+			return
+		}
+		if req.Method != "DELETE" {
+			writeAdminJSON(resWriter, 405, adminError{Error: "Unsupported method: " + req.Method})
+			return
+		}
+		if !s.cancelPipe(id) {
+			writeAdminJSON(resWriter, 404, adminError{Error: "No pipe has the ID"})
+			return
+		}
+		resWriter.WriteHeader(204)
+	})
+}
@@ -0,0 +1,159 @@
+package piping_server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Auth verifies Basic and Bearer credentials of senders or receivers
+type Auth struct {
+	// Realm is used in WWW-Authenticate
+	Realm string
+	// NOTE: username -> password hash in htpasswd format
+	users map[string]string
+	// NOTE: token -> identity
+	tokens map[string]string
+}
+
+func NewAuth() *Auth {
+	return &Auth{
+		Realm:  "Piping Server",
+		users:  map[string]string{},
+		tokens: map[string]string{},
+	}
+}
+
+// AddUser adds a user for Basic authentication. passwordHash is bcrypt or "{SHA}" in htpasswd format.
+func (a *Auth) AddUser(username string, passwordHash string) error {
+	if !strings.HasPrefix(passwordHash, "$2") && !strings.HasPrefix(passwordHash, "{SHA}") {
+		return fmt.Errorf("unsupported password hash of user '%s' (bcrypt and {SHA} are supported)", username)
+	}
+	a.users[username] = passwordHash
+	return nil
+}
+
+// AddToken adds a token for Bearer authentication. identity is used to identify the credential.
+func (a *Auth) AddToken(identity string, token string) {
+	a.tokens[token] = identity
+}
+
+// LoadHtpasswdFile adds users in the htpasswd file
+func (a *Auth) LoadHtpasswdFile(path string) error {
+	return readCredentialLines(path, func(lineNo int, line string) error {
+		username, passwordHash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: should be 'username:password-hash'", path, lineNo)
+		}
+		if err := a.AddUser(username, passwordHash); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		return nil
+	})
+}
+
+// LoadTokensFile adds tokens in the file. Each line is "token" or "identity:token".
+func (a *Auth) LoadTokensFile(path string) error {
+	return readCredentialLines(path, func(lineNo int, line string) error {
+		identity, token, ok := strings.Cut(line, ":")
+		if !ok {
+			token = line
+			hash := sha256.Sum256([]byte(token))
+			identity = "token-" + hex.EncodeToString(hash[:4])
+		}
+		if token == "" {
+			return fmt.Errorf("%s:%d: empty token", path, lineNo)
+		}
+		a.AddToken(identity, token)
+		return nil
+	})
+}
+
+// readCredentialLines calls f for each line except empty lines and comments
+func readCredentialLines(path string, f func(lineNo int, line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f(lineNo, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func verifyPasswordHash(passwordHash string, password string) bool {
+	if strings.HasPrefix(passwordHash, "{SHA}") {
+		hash := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(hash[:])
+		return subtle.ConstantTimeCompare([]byte(passwordHash), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+}
+
+// Authenticate returns the identity of the credential in the request
+func (a *Auth) Authenticate(req *http.Request) (identity string, ok bool) {
+	if username, password, hasBasic := req.BasicAuth(); hasBasic {
+		passwordHash, exists := a.users[username]
+		if !exists || !verifyPasswordHash(passwordHash, password) {
+			return "", false
+		}
+		return username, true
+	}
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		token := authorization[len("Bearer "):]
+		// NOTE: Compare all tokens in constant time not to leak which token is close
+		for t, id := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				identity, ok = id, true
+			}
+		}
+		return
+	}
+	return "", false
+}
+
+// challenges returns values of WWW-Authenticate
+func (a *Auth) challenges() []string {
+	var challenges []string
+	if len(a.users) != 0 {
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q", a.Realm))
+	}
+	if len(a.tokens) != 0 {
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", a.Realm))
+	}
+	return challenges
+}
+
+// authenticate responds 401 and returns false if the request is not authenticated by auth.
+// A nil auth allows all requests.
+func (s *PipingServer) authenticate(auth *Auth, resWriter http.ResponseWriter, req *http.Request) (identity string, ok bool) {
+	if auth == nil {
+		return "", true
+	}
+	if identity, ok = auth.Authenticate(req); ok {
+		return
+	}
+	s.metrics.observeRejection(rejectReasonUnauthorized)
+	resWriter.Header()["WWW-Authenticate"] = auth.challenges()
+	s.respondError(resWriter, req, 401, "[ERROR] Unauthorized.\n")
+	return "", false
+}
@@ -0,0 +1,415 @@
+package piping_server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	modeQueryName   = "mode"
+	modeBroadcast   = "broadcast"
+	replayQueryName = "replay"
+	// broadcastQueueSize is the number of chunks queued for each receiver of a broadcast. A receiver with the full queue is dropped.
+	broadcastQueueSize = 64
+	broadcastChunkSize = 32 * 1024
+)
+
+var errSlowReceiver = errors.New("the receiver is too slow")
+
+// broadcast is a stream from one sender to receivers joining and leaving at any time
+type broadcast struct {
+	mu                sync.Mutex
+	isClosed          bool
+	isSenderConnected bool
+	createdAt         time.Time
+	// NOTE: closed when the broadcast is canceled by the administrator
+	canceledCh chan struct{}
+	// NOTE: closed when the sender starts the stream
+	startedCh chan struct{}
+	// NOTE: set before startedCh is closed
+	header    http.Header
+	senderReq *http.Request
+	startedAt time.Time
+	info      TransferInfo
+	// NOTE: the limit of receivers at the same time set by the sender. Zero means no limit.
+	maxReceivers int
+	receivers    map[*broadcastReceiver]struct{}
+	// NOTE: nil if BroadcastReplaySize is 0
+	replayBuffer *replayBuffer
+	// NOTE: bytes sent so far readable from other goroutines
+	progress atomic.Int64
+	// NOTE: accessed only by the sender
+	lastProgressAt time.Time
+}
+
+type broadcastReceiver struct {
+	req      *http.Request
+	joinedAt time.Time
+	chunkCh  chan []byte
+	// NOTE: set before chunkCh is closed
+	err error
+	// NOTE: set before startedCh is closed if the receiver exceeds the limit of the sender
+	isRejected bool
+}
+
+func getMode(req *http.Request) (string, error) {
+	mode := req.URL.Query().Get(modeQueryName)
+	if mode != "" && mode != modeBroadcast {
+		return "", fmt.Errorf("[ERROR] mode should be %s, but mode = %s.\n", modeBroadcast, mode)
+	}
+	return mode, nil
+}
+
+func getReplaySize(req *http.Request) (int, error) {
+	replayStr := req.URL.Query().Get(replayQueryName)
+	if replayStr == "" {
+		return 0, nil
+	}
+	replay, err := strconv.Atoi(replayStr)
+	if err != nil || replay < 0 {
+		return 0, errors.New("[ERROR] Invalid \"replay\" query parameter\n")
+	}
+	return replay, nil
+}
+
+// getBroadcast returns the locked broadcast on the path
+func (s *PipingServer) getBroadcast(path string) *broadcast {
+	for {
+		b := &broadcast{
+			createdAt:  time.Now(),
+			canceledCh: make(chan struct{}),
+			startedCh:  make(chan struct{}),
+			receivers:  map[*broadcastReceiver]struct{}{},
+		}
+		b, loaded := s.pathToBroadcast.LoadOrStore(path, b)
+		if !loaded {
+			s.metrics.activePipes.Add(1)
+			s.logger.Debug("broadcast created", "path", path)
+		}
+		b.mu.Lock()
+		// NOTE: The broadcast may be closed between LoadOrStore() and Lock()
+		if !b.isClosed {
+			return b
+		}
+		b.mu.Unlock()
+	}
+}
+
+// closeBroadcastLocked removes the broadcast. b.mu should be locked.
+func (s *PipingServer) closeBroadcastLocked(path string, b *broadcast) {
+	if b.isClosed {
+		return
+	}
+	b.isClosed = true
+	s.pathToBroadcast.Delete(path)
+	s.metrics.activePipes.Add(-1)
+}
+
+// closeBroadcastIfUnusedLocked removes the broadcast if no one uses it. b.mu should be locked.
+func (s *PipingServer) closeBroadcastIfUnusedLocked(path string, b *broadcast) {
+	if b.isSenderConnected || len(b.receivers) != 0 {
+		return
+	}
+	s.closeBroadcastLocked(path, b)
+}
+
+// cancelBroadcastLocked aborts the sender and receivers of the broadcast. b.mu should be locked.
+func (s *PipingServer) cancelBroadcastLocked(path string, b *broadcast) {
+	s.closeBroadcastLocked(path, b)
+	close(b.canceledCh)
+	for r := range b.receivers {
+		r.err = errPipeCanceled
+		close(r.chunkCh)
+	}
+	b.receivers = map[*broadcastReceiver]struct{}{}
+}
+
+// rejectReceiversOverLimitLocked rejects receivers which joined after the first maxReceivers receivers. b.mu should be locked.
+func (b *broadcast) rejectReceiversOverLimitLocked() {
+	if b.maxReceivers == 0 || len(b.receivers) <= b.maxReceivers {
+		return
+	}
+	receivers := make([]*broadcastReceiver, 0, len(b.receivers))
+	for r := range b.receivers {
+		receivers = append(receivers, r)
+	}
+	sort.Slice(receivers, func(i, j int) bool {
+		return receivers[i].joinedAt.Before(receivers[j].joinedAt)
+	})
+	for _, r := range receivers[b.maxReceivers:] {
+		r.isRejected = true
+		delete(b.receivers, r)
+	}
+}
+
+// removeBroadcastReceiver removes the receiver leaving the broadcast
+func (s *PipingServer) removeBroadcastReceiver(path string, b *broadcast, r *broadcastReceiver) {
+	b.mu.Lock()
+	delete(b.receivers, r)
+	s.closeBroadcastIfUnusedLocked(path, b)
+	b.mu.Unlock()
+}
+
+// sendBroadcastChunk queues the chunk for all receivers and drops receivers with the full queue
+func (s *PipingServer) sendBroadcastChunk(path string, b *broadcast, chunk []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.replayBuffer != nil {
+		b.replayBuffer.Write(chunk)
+	}
+	for r := range b.receivers {
+		select {
+		case r.chunkCh <- chunk:
+		default:
+			r.err = errSlowReceiver
+			close(r.chunkCh)
+			delete(b.receivers, r)
+			s.logger.Warn("broadcast receiver dropped", "path", path, "reason", errSlowReceiver.Error())
+		}
+	}
+}
+
+// startBroadcast streams the body of the sender to receivers joining at any time without waiting for them.
+// maxReceivers limits the number of receivers at the same time. Zero means no limit.
+func (s *PipingServer) startBroadcast(path string, resWriter http.ResponseWriter, req *http.Request, encryptor *encryptingReader, maxReceivers int) {
+	if encryptor != nil {
+		s.metrics.observeRejection(rejectReasonInvalidMode)
+		s.respondError(resWriter, req, 400, "[ERROR] An encrypted transfer cannot be broadcast.\n")
+		return
+	}
+	if len(req.Header.Values("Content-Range")) != 0 {
+		s.metrics.observeRejection(rejectReasonInvalidMode)
+		s.respondError(resWriter, req, 400, "[ERROR] Content-Range is not supported in a broadcast.\n")
+		return
+	}
+	if _, ok := s.pathToPipe.Load(path); ok {
+		s.metrics.observeRejection(rejectReasonInvalidMode)
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] '%s' is used for a transfer which is not a broadcast.\n", path))
+		return
+	}
+	if s.rejectNewPipeIfShuttingDown(resWriter, req, path) {
+		return
+	}
+	b := s.getBroadcast(path)
+	if b.isSenderConnected {
+		b.mu.Unlock()
+		s.metrics.observeRejection(rejectReasonDuplicateSender)
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] Another sender has been connected on '%s'.\n", path))
+		return
+	}
+	transferHeader, body := getTransferHeaderAndBody(req)
+	b.isSenderConnected = true
+	b.senderReq = req
+	b.maxReceivers = maxReceivers
+	b.header = s.newReceiverHeader(req, transferHeader)
+	// NOTE: Receivers get the stream from the middle
+	b.header.Del("Content-Length")
+	if s.BroadcastReplaySize > 0 {
+		b.replayBuffer = &replayBuffer{size: s.BroadcastReplaySize}
+	}
+	b.rejectReceiversOverLimitLocked()
+	receiverAddrs := []string{}
+	for r := range b.receivers {
+		receiverAddrs = append(receiverAddrs, r.req.RemoteAddr)
+	}
+	b.startedAt = time.Now()
+	b.info = TransferInfo{Path: path, SenderAddr: req.RemoteAddr, ReceiverAddrs: receiverAddrs, TotalLength: req.ContentLength}
+	close(b.startedCh)
+	b.mu.Unlock()
+	s.logger.Info("broadcast started", "path", path, "sender_addr", req.RemoteAddr, "receiver_addrs", receiverAddrs)
+	s.hooks().OnSenderConnected(req)
+	s.hooks().OnTransferStart(b.info)
+
+	s.writeSenderResponseHeader(resWriter, req, 200)
+
+	resWriteFlusher := newSenderWriter(resWriter, req)
+	resWriteFlusher.Write([]byte(fmt.Sprintf("[INFO] Broadcasting on '%s'. Receivers can join at any time.\n", path)))
+	reader, releaseRateLimit := s.rateLimitReader(req, body)
+	defer releaseRateLimit()
+	finishedCh := make(chan struct{})
+	go func() {
+		select {
+		case <-b.canceledCh:
+			// Interrupt reading the body
+			http.NewResponseController(resWriter).SetReadDeadline(time.Now())
+		case <-finishedCh:
+		}
+	}()
+	var n int64
+	var err error
+	buf := make([]byte, broadcastChunkSize)
+	for {
+		m, readErr := reader.Read(buf)
+		if m > 0 {
+			// NOTE: The chunk is shared by the receivers
+			s.sendBroadcastChunk(path, b, bytes.Clone(buf[:m]))
+			n += int64(m)
+			b.progress.Store(n)
+			s.metrics.transferredBytes.Add(int64(m))
+			s.reportProgress(b.info, &b.lastProgressAt, n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+	close(finishedCh)
+	select {
+	case <-b.canceledCh:
+		err = errPipeCanceled
+	default:
+	}
+	b.mu.Lock()
+	for r := range b.receivers {
+		r.err = err
+		close(r.chunkCh)
+	}
+	b.receivers = map[*broadcastReceiver]struct{}{}
+	b.isSenderConnected = false
+	b.senderReq = nil
+	s.closeBroadcastIfUnusedLocked(path, b)
+	b.mu.Unlock()
+	duration := time.Since(b.startedAt)
+	s.metrics.observeTransferDuration(duration)
+	s.hooks().OnTransferEnd(b.info, n, duration, err)
+	if err == nil {
+		resWriteFlusher.Write([]byte("[INFO] Sent successfully!\n"))
+		s.logger.Info("broadcast finished", "path", path, "bytes", n, "duration", duration)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	var quotaErr *quotaExceededError
+	switch {
+	case errors.Is(err, errPipeCanceled):
+		resWriteFlusher.Write([]byte("[ERROR] The pipe was canceled by the administrator.\n"))
+	case errors.As(err, &maxBytesErr):
+		resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] The body exceeds the limit of %d bytes.\n", maxBytesErr.Limit)))
+	case errors.As(err, &quotaErr):
+		resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] %s\n", quotaErr)))
+	}
+	s.logger.Warn("broadcast aborted", "path", path, "bytes", n, "duration", duration, "reason", err.Error())
+}
+
+// receiveBroadcast joins the receiver to the broadcast on the path.
+// maxReceivers limits the number of receivers at the same time in addition to the limit of the sender. Zero means no limit.
+// It returns false if the receiver does not request a broadcast and no broadcast is streaming on the path.
+func (s *PipingServer) receiveBroadcast(path string, resWriter http.ResponseWriter, req *http.Request, mode string, maxReceivers int) bool {
+	if mode != modeBroadcast {
+		b, ok := s.pathToBroadcast.Load(path)
+		if !ok {
+			return false
+		}
+		b.mu.Lock()
+		isStreaming := b.isSenderConnected && !b.isClosed
+		b.mu.Unlock()
+		if !isStreaming {
+			return false
+		}
+	}
+	replaySize, err := getReplaySize(req)
+	if err != nil {
+		s.metrics.observeRejection(rejectReasonInvalidMode)
+		s.respondError(resWriter, req, 400, err.Error())
+		return true
+	}
+	b := s.getBroadcast(path)
+	if b.maxReceivers != 0 && (maxReceivers == 0 || b.maxReceivers < maxReceivers) {
+		maxReceivers = b.maxReceivers
+	}
+	if maxReceivers != 0 && len(b.receivers) >= maxReceivers {
+		b.mu.Unlock()
+		s.metrics.observeRejection(rejectReasonReceiverLimit)
+		s.respondError(resWriter, req, 400, "[ERROR] The number of receivers has reached limits.\n")
+		return true
+	}
+	r := &broadcastReceiver{req: req, joinedAt: time.Now(), chunkCh: make(chan []byte, broadcastQueueSize)}
+	var replay []byte
+	if b.replayBuffer != nil {
+		buf := b.replayBuffer.buf
+		replay = bytes.Clone(buf[max(len(buf)-replaySize, 0):])
+	}
+	b.receivers[r] = struct{}{}
+	startedCh := b.startedCh
+	b.mu.Unlock()
+	s.logger.Info("broadcast receiver joined", "path", path, "remote_addr", req.RemoteAddr, "replay", len(replay))
+	s.hooks().OnReceiverConnected(req)
+	waitCtx, cancelWait := s.waitContext(req.Context())
+	defer cancelWait()
+	select {
+	case <-startedCh:
+	case <-b.canceledCh:
+		s.respondError(resWriter, req, 410, "[ERROR] The pipe was canceled by the administrator.\n")
+		return true
+	case <-s.shuttingDownCh:
+		select {
+		// NOTE: A receiver joining a running broadcast is not released
+		case <-startedCh:
+		default:
+			s.removeBroadcastReceiver(path, b, r)
+			s.respondError(resWriter, req, 503, shuttingDownMessage)
+			return true
+		}
+	case <-waitCtx.Done():
+		s.removeBroadcastReceiver(path, b, r)
+		if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+			s.respondError(resWriter, req, 408, fmt.Sprintf("[ERROR] Timed out waiting for a sender for %s.\n", s.WaitTimeout))
+		}
+		return true
+	}
+	b.mu.Lock()
+	isRejected := r.isRejected
+	b.mu.Unlock()
+	if isRejected {
+		s.metrics.observeRejection(rejectReasonReceiverLimit)
+		s.respondError(resWriter, req, 400, "[ERROR] The number of receivers has reached limits.\n")
+		return true
+	}
+	for key, values := range b.header {
+		resWriter.Header()[key] = values
+	}
+	s.setAllowOrigin(resWriter.Header(), req)
+	resWriter.WriteHeader(200)
+	if f, ok := resWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	writer := NewWriteFlusherIfPossible(resWriter)
+	if len(replay) != 0 {
+		if _, err := writer.Write(replay); err != nil {
+			s.removeBroadcastReceiver(path, b, r)
+			return true
+		}
+	}
+	for {
+		select {
+		case chunk, ok := <-r.chunkCh:
+			if !ok {
+				if r.err != nil {
+					// Abort not to make the receiver regard the partial body as complete
+					panic(http.ErrAbortHandler)
+				}
+				return true
+			}
+			if _, err := writer.Write(chunk); err != nil {
+				s.removeBroadcastReceiver(path, b, r)
+				s.logger.Info("broadcast receiver left", "path", path, "remote_addr", req.RemoteAddr)
+				return true
+			}
+		case <-req.Context().Done():
+			s.removeBroadcastReceiver(path, b, r)
+			s.logger.Info("broadcast receiver left", "path", path, "remote_addr", req.RemoteAddr)
+			return true
+		}
+	}
+}
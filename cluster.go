@@ -0,0 +1,200 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardedHeader marks a request proxied from a peer not to proxy it again
+const forwardedHeader = "X-Piping-Forwarded"
+
+const forwardedForHeader = "X-Forwarded-For"
+
+// virtualNodesPerPeer is the number of points of each peer on the hash ring
+const virtualNodesPerPeer = 100
+
+// peerIPsTTL is the duration for which IP addresses of peers are cached
+const peerIPsTTL = time.Minute
+
+// Registry locates the node where the pipe on a path is.
+// A sender and receivers on the same path meet on the node.
+type Registry interface {
+	// Locate returns the base URL of the peer node for the path or nil if the pipe is on this node
+	Locate(path string) *url.URL
+	// IsPeer returns true if the IP address is of a peer node. Only requests from peers are trusted as proxied.
+	IsPeer(ip string) bool
+}
+
+type ringPoint struct {
+	hash uint64
+	peer *url.URL
+}
+
+// ClusterRegistry distributes paths over a static list of peers by consistent hashing
+type ClusterRegistry struct {
+	self  *url.URL
+	peers []*url.URL
+	ring  []ringPoint
+
+	mu sync.Mutex
+	// NOTE: resolved again after peerIPsExpiresAt
+	peerIPs          []net.IP
+	peerIPsExpiresAt time.Time
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// NewClusterRegistry creates a registry of the peers. self is the URL of this node and should be in peers.
+// All nodes should have the same peers.
+func NewClusterRegistry(self string, peers []string) (*ClusterRegistry, error) {
+	registry := &ClusterRegistry{}
+	for _, peer := range peers {
+		peerURL, err := url.Parse(strings.TrimSuffix(peer, "/"))
+		if err != nil {
+			return nil, err
+		}
+		if peerURL.Scheme != "http" && peerURL.Scheme != "https" {
+			return nil, fmt.Errorf("peer URL should start with http:// or https:// but '%s'", peer)
+		}
+		if peerURL.String() == strings.TrimSuffix(self, "/") {
+			registry.self = peerURL
+		}
+		registry.peers = append(registry.peers, peerURL)
+		for i := 0; i < virtualNodesPerPeer; i++ {
+			registry.ring = append(registry.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", peerURL, i)), peer: peerURL})
+		}
+	}
+	if registry.self == nil {
+		return nil, errors.New("self should be in peers")
+	}
+	sort.Slice(registry.ring, func(i, j int) bool {
+		return registry.ring[i].hash < registry.ring[j].hash
+	})
+	return registry, nil
+}
+
+// Owner returns the base URL of the peer owning the path
+func (r *ClusterRegistry) Owner(path string) *url.URL {
+	hash := hashString(path)
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= hash
+	})
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].peer
+}
+
+func (r *ClusterRegistry) Locate(path string) *url.URL {
+	owner := r.Owner(path)
+	if owner == r.self {
+		return nil
+	}
+	return owner
+}
+
+// IsPeer returns true if the IP address is of a peer. Host names of peers are resolved at most once per peerIPsTTL.
+func (r *ClusterRegistry) IsPeer(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, peerIP := range r.getPeerIPs() {
+		if parsedIP.Equal(peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPeerIPs returns the cached IP addresses of the peers and resolves them if the cache is expired
+func (r *ClusterRegistry) getPeerIPs() []net.IP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.peerIPsExpiresAt) {
+		return r.peerIPs
+	}
+	var peerIPs []net.IP
+	for _, peer := range r.peers {
+		hosts := []string{peer.Hostname()}
+		if net.ParseIP(peer.Hostname()) == nil {
+			var err error
+			if hosts, err = net.LookupHost(peer.Hostname()); err != nil {
+				continue
+			}
+		}
+		for _, host := range hosts {
+			if peerIP := net.ParseIP(host); peerIP != nil {
+				peerIPs = append(peerIPs, peerIP)
+			}
+		}
+	}
+	r.peerIPs = peerIPs
+	r.peerIPsExpiresAt = time.Now().Add(peerIPsTTL)
+	return peerIPs
+}
+
+// trustForwardedRequest replaces RemoteAddr of the request proxied from a peer with the IP address of the client.
+// It removes forwardedHeader from a request not from a peer not to skip proxying.
+func (s *PipingServer) trustForwardedRequest(req *http.Request) {
+	if req.Header.Get(forwardedHeader) == "" {
+		return
+	}
+	if s.Registry == nil || !s.Registry.IsPeer(remoteIP(req)) {
+		req.Header.Del(forwardedHeader)
+		return
+	}
+	// NOTE: The last address is added by the peer
+	forwardedFor := req.Header.Values(forwardedForHeader)
+	if len(forwardedFor) == 0 {
+		return
+	}
+	addrs := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+	if clientIP := strings.TrimSpace(addrs[len(addrs)-1]); net.ParseIP(clientIP) != nil {
+		req.RemoteAddr = clientIP
+	}
+}
+
+// proxyIfRemote proxies the request to the peer owning the path and returns true if the pipe is not on this node
+func (s *PipingServer) proxyIfRemote(resWriter http.ResponseWriter, req *http.Request) bool {
+	if s.Registry == nil || req.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	peer := s.Registry.Locate(req.URL.Path)
+	if peer == nil {
+		return false
+	}
+	s.logger.Debug("proxying", "path", req.URL.Path, "peer", peer.String())
+	// NOTE: The response should be sent while reading the body of the sender
+	http.NewResponseController(resWriter).EnableFullDuplex()
+	// NOTE: The path prefix stripped in ServeHTTP() is needed on the peer
+	target := *peer
+	target.Path = strings.TrimSuffix(peer.Path, "/") + strings.TrimSuffix(s.PathPrefix, "/")
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&target)
+			r.SetXForwarded()
+			r.Out.Header.Set(forwardedHeader, "1")
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(resWriter http.ResponseWriter, req *http.Request, err error) {
+			s.logger.Warn("failed to proxy", "path", req.URL.Path, "peer", peer.String(), "error", err.Error())
+			s.respondError(resWriter, req, 502, "[ERROR] Failed to connect to the node of the path.\n")
+		},
+	}
+	proxy.ServeHTTP(resWriter, req)
+	return true
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net/http"
+	"os"
+)
+
+// newACMEManager creates a manager obtaining and renewing certificates of the domains.
+// caCertPath is a PEM file of CAs trusted to connect to the ACME directory (e.g. the root of Pebble) if not empty.
+func newACMEManager(domains []string, directoryURL string, email string, cacheDir string, caCertPath string) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+	if caCertPath != "" {
+		pem, err := os.ReadFile(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate in PEM", caCertPath)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		httpClient = &http.Client{Transport: transport}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+		Client: &acme.Client{
+			DirectoryURL: directoryURL,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// newTLSConfig returns the config of HTTPS and HTTP/3 with certificates of acmeManager if not nil, or the certificate files
+func newTLSConfig(acmeManager *autocert.Manager, keyPath string, crtPath string) (*tls.Config, error) {
+	if acmeManager != nil {
+		// NOTE: TLS-ALPN-01 challenges are served on the HTTPS port
+		return acmeManager.TLSConfig(), nil
+	}
+	if keyPath == "" {
+		return nil, errors.New("--key-path should be specified")
+	}
+	if crtPath == "" {
+		return nil, errors.New("--crt-path should be specified")
+	}
+	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// newHTTPHandler returns the handler of the HTTP port serving HTTP-01 challenges of acmeManager if not nil
+func newHTTPHandler(handler http.Handler, acmeManager *autocert.Manager) http.Handler {
+	httpHandler := h2c.NewHandler(handler, &http2.Server{})
+	if acmeManager != nil {
+		// NOTE: HTTP-01 challenges are served on the HTTP port
+		return acmeManager.HTTPHandler(httpHandler)
+	}
+	return httpHandler
+}
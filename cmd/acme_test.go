@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/nwtgck/go-piping-server"
+	"github.com/quic-go/quic-go/http3"
+	"gotest.tools/v3/assert"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	cacheDir := t.TempDir()
+	manager, err := newACMEManager([]string{"example.com"}, "https://localhost:14000/dir", "admin@example.com", cacheDir, "")
+	assert.NilError(t, err)
+	assert.Equal(t, manager.Client.DirectoryURL, "https://localhost:14000/dir")
+	assert.Equal(t, manager.Email, "admin@example.com")
+	assert.NilError(t, manager.HostPolicy(context.Background(), "example.com"))
+	assert.Assert(t, manager.HostPolicy(context.Background(), "example.org") != nil)
+
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caCertPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newACMEManager([]string{"example.com"}, "https://localhost:14000/dir", "", cacheDir, caCertPath)
+	assert.Error(t, err, caCertPath+": no certificate in PEM")
+}
+
+// TestACMEWithPebble obtains a certificate from Pebble (https://github.com/letsencrypt/pebble) through the handlers used by RootCmd.
+// It runs only if PIPING_TEST_PEBBLE_URL is set to the directory URL (e.g. https://localhost:14000/dir).
+//   - PIPING_TEST_PEBBLE_CA_CERT: PEM file of the CA of the directory (e.g. test/certs/pebble.minica.pem in Pebble)
+//   - PIPING_TEST_PEBBLE_DOMAIN: domain resolved to this host by Pebble (default: piping.example.com, e.g. with pebble-challtestsrv -defaultIPv4 127.0.0.1)
+//   - PIPING_TEST_PEBBLE_HTTP_PORT: port where Pebble validates HTTP-01 challenges (default: 5002)
+func TestACMEWithPebble(t *testing.T) {
+	directoryURL := os.Getenv("PIPING_TEST_PEBBLE_URL")
+	if directoryURL == "" {
+		t.Skip("PIPING_TEST_PEBBLE_URL is not set")
+	}
+	domain := os.Getenv("PIPING_TEST_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "piping.example.com"
+	}
+	httpPort := os.Getenv("PIPING_TEST_PEBBLE_HTTP_PORT")
+	if httpPort == "" {
+		httpPort = "5002"
+	}
+	acmeManager, err := newACMEManager([]string{domain}, directoryURL, "", t.TempDir(), os.Getenv("PIPING_TEST_PEBBLE_CA_CERT"))
+	assert.NilError(t, err)
+	pipingServer := piping_server.NewServerWithConfig(piping_server.Config{
+		LogHandler: slog.NewTextHandler(io.Discard, nil),
+	})
+
+	// NOTE: Pebble validates HTTP-01 challenges on the HTTP port.
+	// TLS-ALPN-01 challenges fail because the HTTPS port is not the port of Pebble, and autocert falls back to HTTP-01.
+	httpLn, err := net.Listen("tcp", ":"+httpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: newHTTPHandler(pipingServer, acmeManager)}
+	go httpServer.Serve(httpLn)
+	defer httpServer.Close()
+
+	tlsConfig, err := newTLSConfig(acmeManager, "", "")
+	assert.NilError(t, err)
+	httpsLn, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsServer := &http.Server{Handler: pipingServer, TLSConfig: tlsConfig}
+	go httpsServer.ServeTLS(httpsLn, "", "")
+	defer httpsServer.Close()
+	// NOTE: The certificates are shared with HTTPS as in RootCmd
+	udpConn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	http3Server := &http3.Server{Handler: pipingServer, TLSConfig: tlsConfig}
+	go http3Server.Serve(udpConn)
+	defer http3Server.Close()
+
+	// NOTE: The chain is not verified because the root of Pebble changes on each start
+	clientTLSConfig := &tls.Config{ServerName: domain, InsecureSkipVerify: true}
+	httpsClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: clientTLSConfig},
+		Timeout:   2 * time.Minute,
+	}
+	res, err := httpsClient.Get("https://" + httpsLn.Addr().String() + "/version")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, 200)
+	cert := res.TLS.PeerCertificates[0]
+	assert.NilError(t, cert.VerifyHostname(domain))
+	assert.Assert(t, strings.Contains(cert.Issuer.CommonName, "Pebble"), cert.Issuer.CommonName)
+
+	http3Client := &http.Client{
+		Transport: &http3.RoundTripper{TLSClientConfig: clientTLSConfig},
+		Timeout:   time.Minute,
+	}
+	res, err = http3Client.Get("https://" + udpConn.LocalAddr().String() + "/version")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Assert(t, res.TLS.PeerCertificates[0].Equal(cert))
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables overriding options (e.g. PIPING_HTTP_PORT for --http-port)
+const envPrefix = "PIPING_"
+
+var configPath string
+
+// nonConfigFlags are flags which can not be set in a config file or environment variables
+var nonConfigFlags = map[string]bool{
+	"help":    true,
+	"version": true,
+	"config":  true,
+}
+
+func init() {
+	RootCmd.PersistentFlags().StringVarP(&configPath, "config", "", "", "Config file in YAML, TOML or JSON (keys are option names such as http-port). PIPING_* environment variables (e.g. PIPING_HTTP_PORT) override it.")
+	RootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return loadConfig(cmd.Flags(), configPath, os.Environ())
+	}
+	configCmd.AddCommand(configPrintCmd)
+	RootCmd.AddCommand(configCmd)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration merged from the config file, environment variables and flags",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := yaml.Marshal(effectiveConfig(cmd.Flags()))
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(out)
+		return err
+	},
+}
+
+func isConfigFlag(flag *pflag.Flag) bool {
+	return !nonConfigFlags[flag.Name] && !flag.Hidden
+}
+
+// loadConfig sets flags not specified in the command line from environment variables and the config file.
+// Environment variables take precedence over the config file. Environment variables of unknown options are ignored.
+func loadConfig(flags *pflag.FlagSet, path string, environ []string) error {
+	changedInCommandLine := map[string]bool{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		changedInCommandLine[flag.Name] = flag.Changed
+	})
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := strings.ReplaceAll(key, "_", "-")
+			flag := flags.Lookup(name)
+			if flag == nil || !isConfigFlag(flag) {
+				return fmt.Errorf("%s: unknown key %q", path, key)
+			}
+			if changedInCommandLine[name] {
+				continue
+			}
+			value, err := configValueToString(flag, values[key])
+			if err != nil {
+				return fmt.Errorf("%s: invalid value of %q: %w", path, key, err)
+			}
+			if err := setFlag(flag, value); err != nil {
+				return fmt.Errorf("%s: invalid value of %q: %w", path, key, err)
+			}
+		}
+	}
+	for _, env := range environ {
+		key, value, _ := strings.Cut(env, "=")
+		name, ok := strings.CutPrefix(key, envPrefix)
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		flag := flags.Lookup(name)
+		// NOTE: Unknown variables are skipped because other programs also set PIPING_* variables
+		// (e.g. PIPING_SERVER_PORT by Kubernetes for a Service named piping-server)
+		if flag == nil || !isConfigFlag(flag) {
+			continue
+		}
+		if changedInCommandLine[name] {
+			continue
+		}
+		if err := setFlag(flag, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q: %w", key, value, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets the value as if it is specified in the command line. Values of a slice flag are separated by commas.
+func setFlag(flag *pflag.Flag, value string) error {
+	// NOTE: Set() of slice flags appends values after the first call
+	if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+		var values []string
+		if value != "" {
+			values = strings.Split(value, ",")
+		}
+		if err := sliceValue.Replace(values); err != nil {
+			return err
+		}
+	} else if err := flag.Value.Set(value); err != nil {
+		return err
+	}
+	flag.Changed = true
+	return nil
+}
+
+// readConfigFile reads the config file in the format of the extension
+func readConfigFile(path string) (map[string]any, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	case ".toml":
+		err = toml.Unmarshal(content, &values)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		// NOTE: Keep numbers as they are written not to format large integers in exponent notation
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file extension %q (.yaml, .yml, .toml or .json)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// configValueToString converts the value in the config file to the string accepted by the flag
+func configValueToString(flag *pflag.Flag, value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	case []any:
+		if _, ok := flag.Value.(pflag.SliceValue); !ok {
+			return "", fmt.Errorf("should be a %s but a list", flag.Value.Type())
+		}
+		elements := make([]string, len(v))
+		for i, element := range v {
+			s, ok := element.(string)
+			if !ok {
+				return "", fmt.Errorf("element %d should be a string", i)
+			}
+			elements[i] = s
+		}
+		return strings.Join(elements, ","), nil
+	default:
+		return "", fmt.Errorf("should be a %s", flag.Value.Type())
+	}
+}
+
+// effectiveConfig returns the values of all options
+func effectiveConfig(flags *pflag.FlagSet) map[string]any {
+	config := map[string]any{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if !isConfigFlag(flag) {
+			return
+		}
+		if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
+			config[flag.Name] = sliceValue.GetSlice()
+			return
+		}
+		switch flag.Value.Type() {
+		case "bool":
+			config[flag.Name] = flag.Value.String() == "true"
+		case "int", "int64", "uint16":
+			n, _ := strconv.ParseInt(flag.Value.String(), 10, 64)
+			config[flag.Name] = n
+		default:
+			config[flag.Name] = flag.Value.String()
+		}
+	})
+	return config
+}
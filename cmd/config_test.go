@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"github.com/spf13/pflag"
+	"gotest.tools/v3/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Uint16("http-port", 8080, "")
+	flags.Bool("enable-https", false, "")
+	flags.Duration("wait-timeout", 0, "")
+	flags.StringSlice("cluster-peers", nil, "")
+	flags.Bool("version", false, "")
+	return flags
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, config := range []struct {
+		name    string
+		content string
+	}{
+		{name: "piping.yaml", content: "http_port: 9000\nenable-https: true\nwait-timeout: 1m\ncluster-peers: [http://a, http://b]\n"},
+		{name: "piping.toml", content: "http_port = 9000\nenable-https = true\nwait-timeout = \"1m\"\ncluster-peers = [\"http://a\", \"http://b\"]\n"},
+		{name: "piping.json", content: `{"http_port": 9000, "enable-https": true, "wait-timeout": "1m", "cluster-peers": ["http://a", "http://b"]}`},
+	} {
+		flags := newTestFlagSet()
+		if err := flags.Parse([]string{"--enable-https=false"}); err != nil {
+			t.Fatal(err)
+		}
+		path := writeConfigFile(t, config.name, config.content)
+		assert.NilError(t, loadConfig(flags, path, []string{"PIPING_WAIT_TIMEOUT=5s", "HOME=/root"}))
+		// NOTE: flags > environment variables > config file
+		assert.DeepEqual(t, effectiveConfig(flags), map[string]any{
+			"http-port":     int64(9000),
+			"enable-https":  false,
+			"wait-timeout":  (5 * time.Second).String(),
+			"cluster-peers": []string{"http://a", "http://b"},
+		})
+	}
+}
+
+func TestLoadConfigIgnoresUnknownEnvironmentVariables(t *testing.T) {
+	flags := newTestFlagSet()
+	// NOTE: Kubernetes sets them for a Service named piping-server
+	assert.NilError(t, loadConfig(flags, "", []string{"PIPING_SERVER_PORT=tcp://10.0.0.1:8080", "PIPING_SERVER_SERVICE_HOST=10.0.0.1", "PIPING_VERSION=true", "PIPING_HTTP_PORT=9000"}))
+	assert.Equal(t, effectiveConfig(flags)["http-port"], int64(9000))
+	version, err := flags.GetBool("version")
+	assert.NilError(t, err)
+	assert.Equal(t, version, false)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := writeConfigFile(t, "piping.yaml", "htp-port: 9000\n")
+	assert.Error(t, loadConfig(newTestFlagSet(), path, nil), path+`: unknown key "htp-port"`)
+	path = writeConfigFile(t, "piping.yaml", "http-port: 70000\n")
+	assert.ErrorContains(t, loadConfig(newTestFlagSet(), path, nil), path+`: invalid value of "http-port": `)
+	path = writeConfigFile(t, "piping.yaml", "version: true\n")
+	assert.Error(t, loadConfig(newTestFlagSet(), path, nil), path+`: unknown key "version"`)
+	path = writeConfigFile(t, "piping.ini", "")
+	assert.Error(t, loadConfig(newTestFlagSet(), path, nil), path+`: unsupported config file extension ".ini" (.yaml, .yml, .toml or .json)`)
+	assert.ErrorContains(t, loadConfig(newTestFlagSet(), "", []string{"PIPING_HTTP_PORT=abc"}), `PIPING_HTTP_PORT: invalid value "abc": `)
+}
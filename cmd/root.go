@@ -1,18 +1,25 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/nwtgck/go-piping-server"
 	"github.com/nwtgck/go-piping-server/version"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
-	"log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var showsVersion bool
@@ -22,6 +29,44 @@ var httpsPort uint16
 var keyPath string
 var crtPath string
 var enableHttp3 bool
+var waitTimeout time.Duration
+var resumeTimeout time.Duration
+var replayBufferSize int
+var logFormat string
+var logLevel string
+var senderHtpasswdPath string
+var senderTokensPath string
+var receiverHtpasswdPath string
+var receiverTokensPath string
+var policyPath string
+var rateLimit int64
+var transferRateLimit int64
+var ipRateLimit int64
+var maxBodySize int64
+var ipDailyQuota int64
+var credentialDailyQuota int64
+var quotaSnapshotPath string
+var shutdownTimeout time.Duration
+var clusterSelf string
+var clusterPeers []string
+var adminPort uint16
+var adminHtpasswdPath string
+var adminTokensPath string
+var adminHashPaths bool
+var acmeDomains []string
+var acmeDirectoryURL string
+var acmeEmail string
+var acmeCacheDir string
+var acmeCACertPath string
+var negotiateContentEncoding bool
+var forwardedHeaders []string
+var blockedHeaders []string
+var digestAlgorithm string
+var storeDir string
+var storeMaxTTL time.Duration
+var storeMaxSize int64
+var storeMaxTotalSize int64
+var broadcastReplaySize int
 
 func init() {
 	cobra.OnInitialize()
@@ -32,6 +77,44 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&keyPath, "key-path", "", "", "Private key path")
 	RootCmd.PersistentFlags().StringVarP(&crtPath, "crt-path", "", "", "Certification path")
 	RootCmd.PersistentFlags().BoolVarP(&enableHttp3, "enable-http3", "", false, "Enable HTTP/3 (experimental)")
+	RootCmd.PersistentFlags().DurationVarP(&waitTimeout, "wait-timeout", "", 0, "Timeout for a sender or receivers waiting for the other side (e.g. 10m, 0 means no timeout)")
+	RootCmd.PersistentFlags().DurationVarP(&resumeTimeout, "resume-timeout", "", 0, "Duration for which a disconnected sender or receiver can resume with Content-Range or Range (e.g. 1m, 0 disables resuming)")
+	RootCmd.PersistentFlags().IntVarP(&replayBufferSize, "replay-buffer-size", "", 0, "Number of the last bytes kept for receivers resuming with Range within --resume-timeout (0 disables)")
+	RootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", "text", "Log format: json or text")
+	RootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Log level: debug, info, warn or error")
+	RootCmd.PersistentFlags().StringVarP(&senderHtpasswdPath, "sender-htpasswd", "", "", "htpasswd file for Basic authentication of senders (bcrypt or {SHA})")
+	RootCmd.PersistentFlags().StringVarP(&senderTokensPath, "sender-tokens-file", "", "", "File of Bearer tokens for senders (one \"token\" or \"name:token\" per line)")
+	RootCmd.PersistentFlags().StringVarP(&receiverHtpasswdPath, "receiver-htpasswd", "", "", "htpasswd file for Basic authentication of receivers (bcrypt or {SHA})")
+	RootCmd.PersistentFlags().StringVarP(&receiverTokensPath, "receiver-tokens-file", "", "", "File of Bearer tokens for receivers (one \"token\" or \"name:token\" per line)")
+	RootCmd.PersistentFlags().StringVarP(&policyPath, "policy-file", "", "", "JSON file of access policies per path prefix (paths matched with no rule are denied)")
+	RootCmd.PersistentFlags().Int64VarP(&rateLimit, "rate-limit", "", 0, "Maximum bytes per second of all transfers (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&transferRateLimit, "transfer-rate-limit", "", 0, "Maximum bytes per second of each transfer (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&ipRateLimit, "ip-rate-limit", "", 0, "Maximum bytes per second of transfers from the same sender IP address (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&maxBodySize, "max-body-size", "", 0, "Maximum body size of a sender in bytes (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&ipDailyQuota, "ip-daily-quota", "", 0, "Maximum bytes sent from the same IP address per day in UTC (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&credentialDailyQuota, "credential-daily-quota", "", 0, "Maximum bytes sent with the same credential per day in UTC (0 means no limit)")
+	RootCmd.PersistentFlags().StringVarP(&quotaSnapshotPath, "quota-snapshot", "", "", "File to save and restore the usage of daily quotas across restarts")
+	RootCmd.PersistentFlags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", 30*time.Second, "Timeout for in-flight transfers to finish after SIGINT or SIGTERM")
+	RootCmd.PersistentFlags().StringVarP(&clusterSelf, "cluster-self", "", "", "URL of this node in --cluster-peers (e.g. http://10.0.0.1:8080)")
+	RootCmd.PersistentFlags().StringSliceVarP(&clusterPeers, "cluster-peers", "", nil, "URLs of all nodes in the cluster. A sender and receivers are proxied to the node owning the path.")
+	RootCmd.PersistentFlags().Uint16VarP(&adminPort, "admin-port", "", 0, "Port of the admin JSON API to list and cancel pipes (0 disables)")
+	RootCmd.PersistentFlags().StringVarP(&adminHtpasswdPath, "admin-htpasswd", "", "", "htpasswd file for Basic authentication of the admin API (bcrypt or {SHA})")
+	RootCmd.PersistentFlags().StringVarP(&adminTokensPath, "admin-tokens-file", "", "", "File of Bearer tokens for the admin API (one \"token\" or \"name:token\" per line)")
+	RootCmd.PersistentFlags().BoolVarP(&adminHashPaths, "admin-hash-paths", "", false, "Hide paths in the admin API and show only their HMAC IDs, which change when the server restarts")
+	RootCmd.PersistentFlags().StringSliceVarP(&acmeDomains, "acme-domain", "", nil, "Domains of certificates obtained and renewed automatically by ACME. HTTPS is enabled and HTTP-01 challenges are served on the HTTP port.")
+	RootCmd.PersistentFlags().StringVarP(&acmeDirectoryURL, "acme-directory-url", "", acme.LetsEncryptURL, "ACME directory URL")
+	RootCmd.PersistentFlags().StringVarP(&acmeEmail, "acme-email", "", "", "Contact email address of the ACME account")
+	RootCmd.PersistentFlags().StringVarP(&acmeCacheDir, "acme-cache-dir", "", "acme-cache", "Directory to cache the ACME account and certificates")
+	RootCmd.PersistentFlags().StringSliceVarP(&forwardedHeaders, "forward-header", "", nil, "Headers forwarded from a sender to receivers in addition to Content-Type, Content-Length, Content-Disposition, Content-Encoding and X-Piping (e.g. Last-Modified,X-Meta-*)")
+	RootCmd.PersistentFlags().StringSliceVarP(&blockedHeaders, "block-header", "", nil, "Headers not forwarded even if they match --forward-header. Hop-by-hop and security-sensitive headers are always blocked.")
+	RootCmd.PersistentFlags().BoolVarP(&negotiateContentEncoding, "negotiate-content-encoding", "", false, "Compress bodies with zstd or gzip by Accept-Encoding of receivers and decompress bodies for receivers not accepting Content-Encoding of senders")
+	RootCmd.PersistentFlags().StringVarP(&digestAlgorithm, "digest", "", "", "Algorithm of digests of bodies sent to receivers in Repr-Digest trailers and to senders: "+strings.Join(piping_server.DigestAlgorithms(), ", ")+" (empty disables)")
+	RootCmd.PersistentFlags().StringVarP(&storeDir, "store-dir", "", "", "Directory where bodies of senders with ?store=<duration> are kept until a receiver gets them (empty disables store-and-forward)")
+	RootCmd.PersistentFlags().DurationVarP(&storeMaxTTL, "store-max-ttl", "", 24*time.Hour, "Maximum duration of ?store=<duration> (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&storeMaxSize, "store-max-size", "", 0, "Maximum bytes of each stored body (0 means no limit)")
+	RootCmd.PersistentFlags().Int64VarP(&storeMaxTotalSize, "store-max-total-size", "", 0, "Maximum bytes of all stored bodies (0 means no limit)")
+	RootCmd.PersistentFlags().IntVarP(&broadcastReplaySize, "broadcast-replay-size", "", 0, "Number of the last bytes of a broadcast kept for receivers joining with ?replay=<bytes> (0 disables)")
+	RootCmd.PersistentFlags().StringVarP(&acmeCACertPath, "acme-ca-cert", "", "", "PEM file of CAs trusted to connect to the ACME directory (e.g. the root of a test server)")
 }
 
 var RootCmd = &cobra.Command{
@@ -39,41 +122,215 @@ var RootCmd = &cobra.Command{
 	Short:        "piping-server",
 	Long:         "Infinitely transfer between any device over pure HTTP",
 	SilenceUsage: true,
+	// NOTE: The completion command is not provided for now
+	CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if showsVersion {
 			fmt.Printf("%s (%s)\n", version.Version, runtime.Version())
 			return nil
 		}
-		logger := log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
-		logger.Printf("Piping Server %s (%s)", version.Version, runtime.Version())
-		pipingServer := piping_server.NewServer(logger)
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+			return fmt.Errorf("--log-level should be debug, info, warn or error but %s", logLevel)
+		}
+		logHandlerOptions := &slog.HandlerOptions{Level: level}
+		var logHandler slog.Handler
+		switch logFormat {
+		case "json":
+			logHandler = slog.NewJSONHandler(os.Stderr, logHandlerOptions)
+		case "text":
+			logHandler = slog.NewTextHandler(os.Stderr, logHandlerOptions)
+		default:
+			return fmt.Errorf("--log-format should be json or text but %s", logFormat)
+		}
+		if digestAlgorithm != "" && !slices.Contains(piping_server.DigestAlgorithms(), digestAlgorithm) {
+			return fmt.Errorf("--digest should be one of %s but %s", strings.Join(piping_server.DigestAlgorithms(), ", "), digestAlgorithm)
+		}
+		logger := slog.New(logHandler)
+		logger.Info("Piping Server started", "version", version.Version, "go_version", runtime.Version())
+		pipingServer := piping_server.NewServerWithConfig(piping_server.Config{
+			LogHandler:               logHandler,
+			WaitTimeout:              waitTimeout,
+			ResumeTimeout:            resumeTimeout,
+			ReplayBufferSize:         replayBufferSize,
+			RateLimit:                rateLimit,
+			TransferRateLimit:        transferRateLimit,
+			IPRateLimit:              ipRateLimit,
+			MaxBodySize:              maxBodySize,
+			IPDailyQuota:             ipDailyQuota,
+			CredentialDailyQuota:     credentialDailyQuota,
+			QuotaSnapshotPath:        quotaSnapshotPath,
+			NegotiateContentEncoding: negotiateContentEncoding,
+			ForwardedHeaders:         forwardedHeaders,
+			BlockedHeaders:           blockedHeaders,
+			DigestAlgorithm:          digestAlgorithm,
+			StoreDir:                 storeDir,
+			StoreMaxTTL:              storeMaxTTL,
+			StoreMaxSize:             storeMaxSize,
+			StoreMaxTotalSize:        storeMaxTotalSize,
+			BroadcastReplaySize:      broadcastReplaySize,
+		})
+		if quotaSnapshotPath != "" {
+			if err := pipingServer.LoadQuotaSnapshot(); err != nil {
+				return err
+			}
+		}
+		if storeDir != "" {
+			if err := pipingServer.PrepareStoreDir(); err != nil {
+				return err
+			}
+		}
+		senderAuth, err := loadAuth(senderHtpasswdPath, senderTokensPath)
+		if err != nil {
+			return err
+		}
+		pipingServer.SenderAuth = senderAuth
+		receiverAuth, err := loadAuth(receiverHtpasswdPath, receiverTokensPath)
+		if err != nil {
+			return err
+		}
+		pipingServer.ReceiverAuth = receiverAuth
+		if policyPath != "" {
+			policy, err := piping_server.LoadPolicyFile(policyPath)
+			if err != nil {
+				return err
+			}
+			pipingServer.Policy = policy
+		}
+		if len(clusterPeers) != 0 {
+			registry, err := piping_server.NewClusterRegistry(clusterSelf, clusterPeers)
+			if err != nil {
+				return err
+			}
+			pipingServer.Registry = registry
+		}
+		adminAuth, err := loadAuth(adminHtpasswdPath, adminTokensPath)
+		if err != nil {
+			return err
+		}
+		if adminPort != 0 && adminAuth == nil {
+			return errors.New("--admin-htpasswd or --admin-tokens-file should be specified with --admin-port")
+		}
+		pipingServer.AdminAuth = adminAuth
+		pipingServer.AdminHashPaths = adminHashPaths
+		var acmeManager *autocert.Manager
+		if len(acmeDomains) != 0 {
+			if keyPath != "" || crtPath != "" {
+				return errors.New("--key-path and --crt-path should not be specified with --acme-domain")
+			}
+			acmeManager, err = newACMEManager(acmeDomains, acmeDirectoryURL, acmeEmail, acmeCacheDir, acmeCACertPath)
+			if err != nil {
+				return err
+			}
+		}
 		errCh := make(chan error)
-		if enableHttps || enableHttp3 {
-			if keyPath == "" {
-				return errors.New("--key-path should be specified")
+		var httpsServer *http.Server
+		var http3Server *http3.Server
+		if enableHttps || enableHttp3 || acmeManager != nil {
+			tlsConfig, err := newTLSConfig(acmeManager, keyPath, crtPath)
+			if err != nil {
+				return err
 			}
-			if crtPath == "" {
-				return errors.New("--crt-path should be specified")
+			httpsServer = &http.Server{
+				Addr:      fmt.Sprintf(":%d", httpsPort),
+				Handler:   pipingServer,
+				TLSConfig: tlsConfig,
 			}
 			go func() {
-				logger.Printf("Listening HTTPS on %d...\n", httpsPort)
-				errCh <- http.ListenAndServeTLS(fmt.Sprintf(":%d", httpsPort), crtPath, keyPath, http.HandlerFunc(pipingServer.Handler))
+				logger.Info("listening HTTPS", "port", httpsPort)
+				errCh <- httpsServer.ListenAndServeTLS("", "")
 			}()
 			if enableHttp3 {
+				// NOTE: The certificates are shared with HTTPS
+				http3Server = &http3.Server{
+					Addr:      fmt.Sprintf(":%d", httpsPort),
+					Handler:   pipingServer,
+					TLSConfig: tlsConfig,
+				}
 				go func() {
-					logger.Printf("Listening HTTP/3 on %d...\n", httpsPort)
-					errCh <- http3.ListenAndServeQUIC(fmt.Sprintf(":%d", httpsPort), crtPath, keyPath, http.HandlerFunc(pipingServer.Handler))
+					logger.Info("listening HTTP/3", "port", httpsPort)
+					errCh <- http3Server.ListenAndServe()
 				}()
 			}
 		}
+		httpServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", httpPort),
+			Handler: newHTTPHandler(pipingServer, acmeManager),
+		}
 		go func() {
-			server := &http.Server{
-				Addr:    fmt.Sprintf(":%d", httpPort),
-				Handler: h2c.NewHandler(http.HandlerFunc(pipingServer.Handler), &http2.Server{}),
-			}
-			logger.Printf("Listening HTTP on %d...\n", httpPort)
-			errCh <- server.ListenAndServe()
+			logger.Info("listening HTTP", "port", httpPort)
+			errCh <- httpServer.ListenAndServe()
 		}()
-		return <-errCh
+		var adminServer *http.Server
+		if adminPort != 0 {
+			adminServer = &http.Server{
+				Addr:    fmt.Sprintf(":%d", adminPort),
+				Handler: pipingServer.AdminHandler(),
+			}
+			go func() {
+				logger.Info("listening admin API", "port", adminPort)
+				errCh <- adminServer.ListenAndServe()
+			}()
+		}
+		signalCh := make(chan os.Signal, 1)
+		signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case err := <-errCh:
+			return err
+		case sig := <-signalCh:
+			logger.Info("signal received", "signal", sig.String(), "shutdown_timeout", shutdownTimeout.String())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := pipingServer.Shutdown(ctx); err != nil {
+			logger.Warn("in-flight transfers did not finish", "error", err.Error())
+		}
+		shutdownServers(ctx, logger, http3Server, httpServer, httpsServer, adminServer)
+		logger.Info("Piping Server stopped")
+		return nil
 	},
 }
+
+// shutdownServers shuts down the servers together. Connections still open when ctx is done are closed.
+func shutdownServers(ctx context.Context, logger *slog.Logger, http3Server *http3.Server, servers ...*http.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("failed to shut down gracefully", "addr", server.Addr, "error", err.Error())
+				server.Close()
+			}
+		}(server)
+	}
+	if http3Server != nil {
+		// NOTE: Transfers have been drained by PipingServer.Shutdown()
+		if err := http3Server.Close(); err != nil {
+			logger.Warn("failed to close HTTP/3 server", "error", err.Error())
+		}
+	}
+	wg.Wait()
+}
+
+// loadAuth returns nil if neither htpasswdPath nor tokensPath is specified
+func loadAuth(htpasswdPath string, tokensPath string) (*piping_server.Auth, error) {
+	if htpasswdPath == "" && tokensPath == "" {
+		return nil, nil
+	}
+	auth := piping_server.NewAuth()
+	if htpasswdPath != "" {
+		if err := auth.LoadHtpasswdFile(htpasswdPath); err != nil {
+			return nil, err
+		}
+	}
+	if tokensPath != "" {
+		if err := auth.LoadTokensFile(tokensPath); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
@@ -0,0 +1,205 @@
+package piping_server
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingBrotli   = "br"
+)
+
+// compressibleEncodings are encodings the server compresses with in order of preference
+var compressibleEncodings = []string{encodingZstd, encodingGzip}
+
+// decodableEncodings are encodings the server decompresses for receivers not accepting them
+var decodableEncodings = map[string]bool{
+	encodingGzip:   true,
+	encodingZstd:   true,
+	encodingBrotli: true,
+}
+
+// normalizeEncoding returns the Content-Encoding in lower case. An empty encoding is "identity".
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	switch encoding {
+	case "":
+		return encodingIdentity
+	case "x-gzip":
+		return encodingGzip
+	}
+	return encoding
+}
+
+// parseAcceptEncoding returns the q-values of codings in Accept-Encoding
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	qValues := map[string]float64{}
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		if strings.TrimSpace(coding) == "" {
+			continue
+		}
+		coding = normalizeEncoding(coding)
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		qValues[coding] = q
+	}
+	return qValues
+}
+
+// acceptsEncoding returns true if the encoding is acceptable in the q-values of Accept-Encoding
+func acceptsEncoding(qValues map[string]float64, encoding string) bool {
+	if q, ok := qValues[encoding]; ok {
+		return q > 0
+	}
+	if q, ok := qValues["*"]; ok {
+		return q > 0
+	}
+	// NOTE: identity is acceptable unless it is excluded explicitly
+	return encoding == encodingIdentity
+}
+
+// negotiateEncoding returns the encoding sent to the receiver for the encoding of the sender
+func negotiateEncoding(senderEncoding string, acceptEncoding string) string {
+	qValues := parseAcceptEncoding(acceptEncoding)
+	if senderEncoding != encodingIdentity {
+		if acceptsEncoding(qValues, senderEncoding) || !decodableEncodings[senderEncoding] {
+			return senderEncoding
+		}
+		return encodingIdentity
+	}
+	best, bestQ := encodingIdentity, 0.0
+	for _, encoding := range compressibleEncodings {
+		if q, ok := qValues[encoding]; ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// contentCoder converts the body of the sender for a receiver
+type contentCoder interface {
+	io.Writer
+	// finish writes the rest of the body. It stops converting if err is not nil.
+	finish(err error) error
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodingWriter compresses the body
+type encodingWriter struct {
+	encoder flushWriteCloser
+}
+
+func (w *encodingWriter) Write(p []byte) (int, error) {
+	n, err := w.encoder.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// NOTE: Flush not to delay streaming
+	return n, w.encoder.Flush()
+}
+
+func (w *encodingWriter) finish(err error) error {
+	if err != nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
+
+// decodingWriter decompresses the body in a goroutine because decoders are readers
+type decodingWriter struct {
+	pipeWriter *io.PipeWriter
+	doneCh     chan struct{}
+	// NOTE: set before doneCh is closed
+	err error
+}
+
+func newDecodingWriter(encoding string, writer io.Writer) *decodingWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	w := &decodingWriter{pipeWriter: pipeWriter, doneCh: make(chan struct{})}
+	go func() {
+		defer close(w.doneCh)
+		var reader io.Reader
+		switch encoding {
+		case encodingGzip:
+			gzipReader, err := gzip.NewReader(pipeReader)
+			if err != nil {
+				w.err = err
+				pipeReader.CloseWithError(err)
+				return
+			}
+			reader = gzipReader
+		case encodingZstd:
+			zstdReader, err := zstd.NewReader(pipeReader, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				w.err = err
+				pipeReader.CloseWithError(err)
+				return
+			}
+			defer zstdReader.Close()
+			reader = zstdReader
+		case encodingBrotli:
+			reader = brotli.NewReader(pipeReader)
+		}
+		_, w.err = io.Copy(writer, reader)
+		// NOTE: Fail writing the rest if the body is broken or has extra bytes
+		if w.err != nil {
+			pipeReader.CloseWithError(w.err)
+		} else {
+			pipeReader.Close()
+		}
+	}()
+	return w
+}
+
+func (w *decodingWriter) Write(p []byte) (int, error) {
+	return w.pipeWriter.Write(p)
+}
+
+func (w *decodingWriter) finish(err error) error {
+	w.pipeWriter.CloseWithError(err)
+	<-w.doneCh
+	return w.err
+}
+
+// newContentCoder returns a coder converting the body from senderEncoding to receiverEncoding
+func newContentCoder(senderEncoding string, receiverEncoding string, writer io.Writer) contentCoder {
+	if senderEncoding != encodingIdentity {
+		return newDecodingWriter(senderEncoding, writer)
+	}
+	switch receiverEncoding {
+	case encodingGzip:
+		return &encodingWriter{encoder: gzip.NewWriter(writer)}
+	case encodingZstd:
+		// NOTE: zstd.NewWriter() fails only with invalid options
+		encoder, _ := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+		return &encodingWriter{encoder: encoder}
+	}
+	return nil
+}
+
+// setReceiverEncodingHeader rewrites the header of a receiver getting the body in the encoding
+func setReceiverEncodingHeader(header http.Header, encoding string) {
+	header.Del("Content-Length")
+	if encoding == encodingIdentity {
+		header.Del("Content-Encoding")
+		return
+	}
+	header.Set("Content-Encoding", encoding)
+}
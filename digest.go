@@ -0,0 +1,167 @@
+package piping_server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"lukechampine.com/blake3"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	reprDigestHeaderName    = "Repr-Digest"
+	contentDigestHeaderName = "Content-Digest"
+	// digestStatusHeaderName is the trailer telling receivers whether the body matches Content-Digest of the sender
+	digestStatusHeaderName = "X-Piping-Digest-Status"
+	digestStatusValid      = "valid"
+	digestStatusInvalid    = "invalid"
+)
+
+var errContentDigestMismatch = errors.New("the body does not match Content-Digest")
+
+// digestAlgorithms are algorithms of Repr-Digest and Content-Digest in the names of RFC 9530
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"blake3":  func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// DigestAlgorithms returns the names of algorithms for Config.DigestAlgorithm
+func DigestAlgorithms() []string {
+	names := make([]string, 0, len(digestAlgorithms))
+	for name := range digestAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// digest computes the digest of the body
+type digest struct {
+	algorithm string
+	hash      hash.Hash
+}
+
+func newDigest(algorithm string) *digest {
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		return nil
+	}
+	return &digest{algorithm: algorithm, hash: newHash()}
+}
+
+// fieldValue returns the digest in the form of Repr-Digest and Content-Digest (e.g. "sha-256=:...:")
+func (d *digest) fieldValue() string {
+	return fmt.Sprintf("%s=:%s:", d.algorithm, base64.StdEncoding.EncodeToString(d.hash.Sum(nil)))
+}
+
+// infoLine returns the line for the sender (e.g. "[INFO] sha256=...")
+func (d *digest) infoLine() string {
+	return fmt.Sprintf("[INFO] %s=%x\n", strings.ReplaceAll(d.algorithm, "-", ""), d.hash.Sum(nil))
+}
+
+// expectedDigest is the digest declared by the sender in Content-Digest
+type expectedDigest struct {
+	*digest
+	sum []byte
+}
+
+func (d *expectedDigest) matches() bool {
+	return bytes.Equal(d.hash.Sum(nil), d.sum)
+}
+
+// parseContentDigest returns the first digest of a supported algorithm in Content-Digest such as "sha-256=:...:, sha-512=:...:".
+// It returns nil if there is no supported digest.
+func parseContentDigest(contentDigest string) *expectedDigest {
+	for _, member := range strings.Split(contentDigest, ",") {
+		algorithm, value, ok := strings.Cut(member, "=")
+		if !ok {
+			continue
+		}
+		// NOTE: Parameters are ignored
+		value, _, _ = strings.Cut(value, ";")
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			continue
+		}
+		if d := newDigest(strings.ToLower(strings.TrimSpace(algorithm))); d != nil {
+			return &expectedDigest{digest: d, sum: sum}
+		}
+	}
+	return nil
+}
+
+// forwardedTrailerNames returns the trailers declared by the sender which are forwarded to receivers
+func (s *PipingServer) forwardedTrailerNames(senderReq *http.Request) []string {
+	// NOTE: The trailers are not available for a multipart body because the rest of the request is not read
+	if mediaType, _, _ := mime.ParseMediaType(senderReq.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		return nil
+	}
+	var names []string
+	for name := range senderReq.Trailer {
+		name = http.CanonicalHeaderKey(name)
+		if builtinForwardedHeaders[name] || name == reprDigestHeaderName || name == digestStatusHeaderName {
+			continue
+		}
+		if matchHeaderPatterns(blockedHeaderPatterns, name) || matchHeaderPatterns(s.BlockedHeaders, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acceptsTrailers returns true if the receiver handles trailers
+func acceptsTrailers(req *http.Request) bool {
+	if req.ProtoMajor >= 2 {
+		return true
+	}
+	for _, value := range req.Header.Values("TE") {
+		for _, element := range strings.Split(value, ",") {
+			coding, _, _ := strings.Cut(element, ";")
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setReceiverTrailers sets the trailers of the receiver in the slot after the body is sent
+func (t *transfer) setReceiverTrailers(slot *receiverSlot) error {
+	header := slot.receiver.resWriter.Header()
+	for _, name := range t.trailerNames {
+		if values := t.senderTrailer.Values(name); len(values) != 0 {
+			header[name] = values
+		}
+	}
+	// NOTE: The digest of the body of the sender is not the digest of a converted body
+	if t.digest != nil && slot.coder == nil {
+		header.Set(reprDigestHeaderName, t.digest.fieldValue())
+	}
+	if t.contentDigest == nil {
+		return nil
+	}
+	if t.contentDigest.matches() {
+		header.Set(digestStatusHeaderName, digestStatusValid)
+		return nil
+	}
+	header.Set(digestStatusHeaderName, digestStatusInvalid)
+	// Abort the receiver not accepting the trailer not to make it regard the broken body as complete
+	if !acceptsTrailers(slot.receiver.req) {
+		return errContentDigestMismatch
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package piping_server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Encrypted stream format of "X-Piping-Encryption: aes-256-gcm"
+//
+//	header: magic "PIPINGE1" (8 bytes) | salt (16 bytes) | nonce prefix (4 bytes)
+//	chunk:  ciphertext length (4 bytes, big endian) | ciphertext with 16-byte tag
+//
+// The key is PBKDF2-HMAC-SHA256(passphrase, salt, 100000 iterations, 32 bytes).
+// The nonce of the i-th chunk (from 0) is the nonce prefix followed by i in 8 bytes big endian.
+// The additional data is 1 byte: 1 for the last chunk, which is empty, and 0 for the others.
+// Receivers should reject a stream without the last chunk as truncated.
+const (
+	encryptionHeaderName       = "X-Piping-Encryption"
+	encryptionAES256GCM        = "aes-256-gcm"
+	passphraseQueryName        = "passphrase"
+	encryptionMagic            = "PIPINGE1"
+	encryptionSaltSize         = 16
+	encryptionNoncePrefixSize  = 4
+	encryptionPBKDF2Iterations = 100000
+	encryptionMaxChunkSize     = 64 * 1024
+)
+
+// getEncryptionPassphrase returns the passphrase if the sender requests encryption
+func getEncryptionPassphrase(req *http.Request) (passphrase string, encrypts bool, err error) {
+	encryption := req.Header.Get(encryptionHeaderName)
+	if encryption == "" {
+		return "", false, nil
+	}
+	if encryption != encryptionAES256GCM {
+		return "", false, errors.New("[ERROR] X-Piping-Encryption should be aes-256-gcm.\n")
+	}
+	passphrase = req.URL.Query().Get(passphraseQueryName)
+	if passphrase == "" {
+		return "", false, errors.New("[ERROR] \"passphrase\" query parameter is required for encryption.\n")
+	}
+	return passphrase, true, nil
+}
+
+// redactedURL returns the URL without the passphrase not to store it in logs
+func redactedURL(u *url.URL) string {
+	query := u.Query()
+	if !query.Has(passphraseQueryName) {
+		return u.String()
+	}
+	query.Set(passphraseQueryName, "REDACTED")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// encryptingReader encrypts the reader in the chunked AES-256-GCM format
+type encryptingReader struct {
+	// NOTE: set before reading
+	reader      io.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint64
+	plain       []byte
+	// NOTE: encrypted bytes not read yet
+	pending []byte
+	eof     bool
+}
+
+func newEncryptingReader(passphrase string) (*encryptingReader, error) {
+	salt := make([]byte, encryptionSaltSize)
+	noncePrefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, encryptionPBKDF2Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(encryptionMagic), salt...), noncePrefix...)
+	return &encryptingReader{
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		plain:       make([]byte, encryptionMaxChunkSize),
+		pending:     header,
+	}, nil
+}
+
+func (r *encryptingReader) seal(plain []byte, isLast bool) {
+	nonce := binary.BigEndian.AppendUint64(append([]byte(nil), r.noncePrefix...), r.counter)
+	r.counter++
+	additionalData := []byte{0}
+	if isLast {
+		additionalData[0] = 1
+	}
+	r.pending = binary.BigEndian.AppendUint32(r.pending, uint32(len(plain)+r.aead.Overhead()))
+	r.pending = r.aead.Seal(r.pending, nonce, plain, additionalData)
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		// NOTE: Each read becomes a chunk not to delay streaming
+		n, err := r.reader.Read(r.plain)
+		if n > 0 {
+			r.seal(r.plain[:n], false)
+		}
+		if err == io.EOF {
+			r.seal(nil, true)
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
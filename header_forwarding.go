@@ -0,0 +1,118 @@
+package piping_server
+
+import (
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// builtinForwardedHeaders are always forwarded from a sender to receivers by startTransfer()
+var builtinForwardedHeaders = map[string]bool{
+	"Content-Type":        true,
+	"Content-Length":      true,
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"X-Piping":            true,
+	encryptionHeaderName:  true,
+}
+
+// blockedHeaderPatterns are hop-by-hop and security-sensitive headers never forwarded by Config.ForwardedHeaders.
+// A pattern ending with "*" matches headers with the prefix.
+var blockedHeaderPatterns = []string{
+	// hop-by-hop
+	"Connection",
+	"Keep-Alive",
+	"Proxy-*",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	// security-sensitive
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"Host",
+	"Origin",
+	"Referer",
+	"Access-Control-*",
+	"Sec-*",
+	"Forwarded",
+	"X-Forwarded-*",
+	"X-Real-Ip",
+	forwardedHeader,
+	"Strict-Transport-Security",
+	"Content-Security-Policy",
+	"Alt-Svc",
+	// meaningless for receivers
+	"Content-Range",
+	"Range",
+	"Expect",
+}
+
+// matchHeaderPattern matches the canonical header name with the pattern
+func matchHeaderPattern(pattern string, name string) bool {
+	pattern = http.CanonicalHeaderKey(pattern)
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
+
+func matchHeaderPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchHeaderPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isForwardedHeader returns true if the header of a sender is forwarded to receivers by Config.ForwardedHeaders
+func (s *PipingServer) isForwardedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if builtinForwardedHeaders[name] {
+		return false
+	}
+	if matchHeaderPatterns(blockedHeaderPatterns, name) || matchHeaderPatterns(s.BlockedHeaders, name) {
+		return false
+	}
+	return matchHeaderPatterns(s.ForwardedHeaders, name)
+}
+
+// forwardHeaders copies headers allowed by Config.ForwardedHeaders and returns their names
+func (s *PipingServer) forwardHeaders(receiverHeader http.Header, transferHeader textproto.MIMEHeader) []string {
+	if len(s.ForwardedHeaders) == 0 {
+		return nil
+	}
+	var names []string
+	for name, values := range transferHeader {
+		if s.isForwardedHeader(name) {
+			receiverHeader[http.CanonicalHeaderKey(name)] = values
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allowedForwardedRequestHeaders returns headers for Access-Control-Allow-Headers by Config.ForwardedHeaders.
+// Headers in Access-Control-Request-Headers matching wildcard patterns are also allowed.
+func (s *PipingServer) allowedForwardedRequestHeaders(req *http.Request) []string {
+	var names []string
+	for _, pattern := range s.ForwardedHeaders {
+		if !strings.HasSuffix(pattern, "*") && s.isForwardedHeader(pattern) {
+			names = append(names, http.CanonicalHeaderKey(pattern))
+		}
+	}
+	for _, value := range req.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || !s.isForwardedHeader(name) || matchHeaderPatterns(names, name) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,84 @@
+package piping_server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Role is the role of a request on a path
+type Role string
+
+const (
+	RoleSender   Role = "sender"
+	RoleReceiver Role = "receiver"
+)
+
+// progressHookInterval is the minimum interval of Hooks.OnTransferProgress()
+const progressHookInterval = time.Second
+
+// TransferInfo describes a transfer passed to Hooks
+type TransferInfo struct {
+	Path          string
+	SenderAddr    string
+	ReceiverAddrs []string
+	// TotalLength is -1 if unknown
+	TotalLength int64
+}
+
+// Hooks is called on the lifecycle of transfers. Embed NopHooks to implement some of the methods.
+// The methods are called synchronously and should return quickly.
+// Storing a body with the "store" query parameter and sending the stored body are reported as separate transfers.
+type Hooks interface {
+	// Authorize vetoes the request with 403 by returning an error. The error message is sent to the client.
+	Authorize(req *http.Request, role Role) error
+	// OnSenderConnected is called when a sender starts waiting for receivers
+	OnSenderConnected(req *http.Request)
+	// OnReceiverConnected is called when a receiver starts waiting for a sender
+	OnReceiverConnected(req *http.Request)
+	// OnTransferStart is called when all receivers are connected and the transfer starts
+	OnTransferStart(info TransferInfo)
+	// OnTransferProgress is called with the bytes sent so far at most once per second
+	OnTransferProgress(info TransferInfo, bytes int64)
+	// OnTransferEnd is called when the transfer ends. err is nil if all the body is sent.
+	OnTransferEnd(info TransferInfo, bytes int64, duration time.Duration, err error)
+}
+
+// NopHooks implements Hooks doing nothing
+type NopHooks struct{}
+
+func (NopHooks) Authorize(*http.Request, Role) error                     { return nil }
+func (NopHooks) OnSenderConnected(*http.Request)                         {}
+func (NopHooks) OnReceiverConnected(*http.Request)                       {}
+func (NopHooks) OnTransferStart(TransferInfo)                            {}
+func (NopHooks) OnTransferProgress(TransferInfo, int64)                  {}
+func (NopHooks) OnTransferEnd(TransferInfo, int64, time.Duration, error) {}
+
+func (s *PipingServer) hooks() Hooks {
+	if s.Hooks == nil {
+		return NopHooks{}
+	}
+	return s.Hooks
+}
+
+// authorize responds 403 and returns false if Hooks.Authorize() vetoes the request
+func (s *PipingServer) authorize(resWriter http.ResponseWriter, req *http.Request, role Role) bool {
+	if err := s.hooks().Authorize(req, role); err != nil {
+		s.metrics.observeRejection(rejectReasonForbidden)
+		s.respondError(resWriter, req, 403, "[ERROR] "+err.Error()+"\n")
+		return false
+	}
+	return true
+}
+
+// reportProgress calls Hooks.OnTransferProgress() at most once per progressHookInterval
+func (s *PipingServer) reportProgress(info TransferInfo, lastProgressAt *time.Time, bytes int64) {
+	if s.Hooks == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(*lastProgressAt) < progressHookInterval {
+		return
+	}
+	*lastProgressAt = now
+	s.Hooks.OnTransferProgress(info, bytes)
+}
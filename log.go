@@ -0,0 +1,63 @@
+package piping_server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// logLoggerHandler is a slog.Handler writing records to *log.Logger for compatibility with NewServer()
+type logLoggerHandler struct {
+	logger *log.Logger
+	attrs  []slog.Attr
+	groups []string
+}
+
+func newLogLoggerHandler(logger *log.Logger) *logLoggerHandler {
+	return &logLoggerHandler{logger: logger}
+}
+
+func (h *logLoggerHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *logLoggerHandler) Handle(_ context.Context, record slog.Record) error {
+	b := new(strings.Builder)
+	if record.Level != slog.LevelInfo {
+		fmt.Fprintf(b, "[%s] ", record.Level)
+	}
+	b.WriteString(record.Message)
+	prefix := ""
+	if len(h.groups) != 0 {
+		prefix = strings.Join(h.groups, ".") + "."
+	}
+	for _, attr := range h.attrs {
+		fmt.Fprintf(b, " %s=%v", attr.Key, attr.Value)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(b, " %s%s=%v", prefix, attr.Key, attr.Value)
+		return true
+	})
+	return h.logger.Output(2, b.String())
+}
+
+func (h *logLoggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefix := ""
+	if len(h.groups) != 0 {
+		prefix = strings.Join(h.groups, ".") + "."
+	}
+	newAttrs := append([]slog.Attr(nil), h.attrs...)
+	for _, attr := range attrs {
+		newAttrs = append(newAttrs, slog.Attr{Key: prefix + attr.Key, Value: attr.Value})
+	}
+	return &logLoggerHandler{logger: h.logger, attrs: newAttrs, groups: h.groups}
+}
+
+func (h *logLoggerHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &logLoggerHandler{logger: h.logger, attrs: h.attrs, groups: append(append([]string(nil), h.groups...), name)}
+}
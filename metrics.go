@@ -0,0 +1,144 @@
+package piping_server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rejectReasonReservedPath            = "reserved_path"
+	rejectReasonDuplicateSender         = "duplicate_sender"
+	rejectReasonReceiverLimit           = "receiver_limit"
+	rejectReasonServiceWorker           = "service_worker"
+	rejectReasonInvalidNReceivers       = "invalid_n"
+	rejectReasonMismatchedNReceivers    = "mismatched_n"
+	rejectReasonUnsupportedMethod       = "unsupported_method"
+	rejectReasonUnsupportedContentRange = "unsupported_content_range"
+	rejectReasonUnauthorized            = "unauthorized"
+	rejectReasonForbidden               = "forbidden"
+	rejectReasonBodyTooLarge            = "body_too_large"
+	rejectReasonInvalidRate             = "invalid_rate"
+	rejectReasonQuotaExceeded           = "quota_exceeded"
+	rejectReasonShuttingDown            = "shutting_down"
+	rejectReasonInvalidEncryption       = "invalid_encryption"
+	rejectReasonInvalidStore            = "invalid_store"
+	rejectReasonStoreFull               = "store_full"
+	rejectReasonInvalidMode             = "invalid_mode"
+	rejectReasonDigestMismatch          = "digest_mismatch"
+)
+
+var transferDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// metrics is exposed in Prometheus text format on /metrics
+type metrics struct {
+	activePipes      atomic.Int64
+	waitingSenders   atomic.Int64
+	waitingReceivers atomic.Int64
+	transferredBytes atomic.Int64
+
+	mu                     sync.Mutex
+	rejectedRequests       map[string]uint64
+	requests               map[string]uint64
+	transferDurationCounts []uint64 // NOTE: cumulative counts for transferDurationBuckets
+	transferDurationCount  uint64
+	transferDurationSum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejectedRequests:       map[string]uint64{},
+		requests:               map[string]uint64{},
+		transferDurationCounts: make([]uint64, len(transferDurationBuckets)),
+	}
+}
+
+// requestProtocol returns the protocol label of the request
+func requestProtocol(req *http.Request) string {
+	switch {
+	case req.ProtoMajor == 3:
+		return "HTTP/3"
+	case req.TLS != nil:
+		return "HTTPS"
+	case req.ProtoMajor == 2:
+		return "h2c"
+	default:
+		return req.Proto
+	}
+}
+
+func (m *metrics) observeRequest(req *http.Request) {
+	m.mu.Lock()
+	m.requests[requestProtocol(req)]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeRejection(reason string) {
+	m.mu.Lock()
+	m.rejectedRequests[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeTransferDuration(d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bucket := range transferDurationBuckets {
+		if seconds <= bucket {
+			m.transferDurationCounts[i]++
+		}
+	}
+	m.transferDurationCount++
+	m.transferDurationSum += seconds
+}
+
+func writeSortedCounter(w io.Writer, name string, labelName string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, labelName, key, values[key])
+	}
+}
+
+// text returns the metrics in Prometheus text format
+func (m *metrics) text() string {
+	b := new(strings.Builder)
+	fmt.Fprintln(b, "# HELP piping_server_active_pipes Number of paths used by senders or receivers.")
+	fmt.Fprintln(b, "# TYPE piping_server_active_pipes gauge")
+	fmt.Fprintf(b, "piping_server_active_pipes %d\n", m.activePipes.Load())
+	fmt.Fprintln(b, "# HELP piping_server_waiting_senders Number of senders waiting for receivers.")
+	fmt.Fprintln(b, "# TYPE piping_server_waiting_senders gauge")
+	fmt.Fprintf(b, "piping_server_waiting_senders %d\n", m.waitingSenders.Load())
+	fmt.Fprintln(b, "# HELP piping_server_waiting_receivers Number of receivers waiting for a sender.")
+	fmt.Fprintln(b, "# TYPE piping_server_waiting_receivers gauge")
+	fmt.Fprintf(b, "piping_server_waiting_receivers %d\n", m.waitingReceivers.Load())
+	fmt.Fprintln(b, "# HELP piping_server_transferred_bytes_total Number of bytes transferred from senders.")
+	fmt.Fprintln(b, "# TYPE piping_server_transferred_bytes_total counter")
+	fmt.Fprintf(b, "piping_server_transferred_bytes_total %d\n", m.transferredBytes.Load())
+
+	m.mu.Lock()
+	fmt.Fprintln(b, "# HELP piping_server_transfer_duration_seconds Duration of transfers.")
+	fmt.Fprintln(b, "# TYPE piping_server_transfer_duration_seconds histogram")
+	for i, bucket := range transferDurationBuckets {
+		fmt.Fprintf(b, "piping_server_transfer_duration_seconds_bucket{le=\"%g\"} %d\n", bucket, m.transferDurationCounts[i])
+	}
+	fmt.Fprintf(b, "piping_server_transfer_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.transferDurationCount)
+	fmt.Fprintf(b, "piping_server_transfer_duration_seconds_sum %g\n", m.transferDurationSum)
+	fmt.Fprintf(b, "piping_server_transfer_duration_seconds_count %d\n", m.transferDurationCount)
+	fmt.Fprintln(b, "# HELP piping_server_rejected_requests_total Number of rejected requests by reason.")
+	fmt.Fprintln(b, "# TYPE piping_server_rejected_requests_total counter")
+	writeSortedCounter(b, "piping_server_rejected_requests_total", "reason", m.rejectedRequests)
+	fmt.Fprintln(b, "# HELP piping_server_requests_total Number of requests by protocol.")
+	fmt.Fprintln(b, "# TYPE piping_server_requests_total counter")
+	writeSortedCounter(b, "piping_server_requests_total", "protocol", m.requests)
+	m.mu.Unlock()
+	return b.String()
+}
@@ -1,17 +1,24 @@
 package piping_server
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/nwtgck/go-piping-server/syncmap"
 	"github.com/nwtgck/go-piping-server/version"
 	"io"
 	"log"
+	"log/slog"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -21,6 +28,7 @@ const (
 	reservedPathHelp       = "/help"
 	reservedPathFaviconIco = "/favicon.ico"
 	reservedPathRobotsTxt  = "/robots.txt"
+	reservedPathMetrics    = "/metrics"
 )
 
 var reservedPaths = [...]string{
@@ -29,23 +37,148 @@ var reservedPaths = [...]string{
 	reservedPathHelp,
 	reservedPathFaviconIco,
 	reservedPathRobotsTxt,
+	reservedPathMetrics,
 }
 
 const noscriptPathQueryParameterName = "path"
 
+var errReceiverDisconnected = errors.New("receiver disconnected")
+
+var errPipeCanceled = errors.New("pipe canceled by the administrator")
+
+type receiver struct {
+	resWriter http.ResponseWriter
+	req       *http.Request
+	// NOTE: closed by the sender when it finishes using resWriter
+	doneCh chan struct{}
+	// NOTE: set before doneCh is closed
+	transferErr error
+}
+
 type pipe struct {
-	receiverResWriterCh chan http.ResponseWriter
-	sendFinishedCh      chan struct{}
-	isSenderConnected   uint32 // NOTE: for atomic operation
-	isTransferring      uint32 // NOTE: for atomic operation
+	mu                 sync.Mutex
+	nReceivers         int // NOTE: 0 if neither a sender nor receivers have been connected
+	receivers          []*receiver
+	receiversChangedCh chan struct{}
+	isSenderConnected  bool
+	isTransferring     bool
+	isClosed           bool
+	createdAt          time.Time
+	// NOTE: not nil while a sender is connected
+	senderReq *http.Request
+	// NOTE: given to the sender to resume the transfer. Empty if the transfer can not be resumed.
+	resumeToken string
+	// NOTE: closed when the administrator cancels the pipe
+	canceledCh chan struct{}
+	// NOTE: not nil after transferring starts
+	transfer *transfer
+	// NOTE: not nil while waiting for a sender to resume the transfer
+	suspendedTransfer *transfer
+}
+
+// Config is the configuration of PipingServer
+type Config struct {
+	// LogHandler handles structured logs. slog.Default() is used if nil.
+	LogHandler slog.Handler
+	// PathPrefix is stripped from request paths in ServeHTTP() to mount the server under a sub-path (e.g. "/piping")
+	PathPrefix string
+	// AllowedMethods are methods accepted except reserved paths. Nil means GET, HEAD, POST, PUT and OPTIONS.
+	AllowedMethods []string
+	// CORSAllowedOrigins are origins allowed to access in CORS. Nil means all origins ("*").
+	CORSAllowedOrigins []string
+	// ReservedPathHandlers overrides reserved paths such as "/" and "/help".
+	// A nil handler releases the reserved path to be used for transfers.
+	ReservedPathHandlers map[string]http.Handler
+	// WaitTimeout is the maximum duration for which a sender or receivers wait for the other side.
+	// Zero means no timeout.
+	WaitTimeout time.Duration
+	// ResumeTimeout is the duration for which receivers are kept when a sender is disconnected halfway.
+	// A sender can resume the transfer with Content-Range within the duration. Zero disables resumable uploads.
+	ResumeTimeout time.Duration
+	// ReplayBufferSize is the number of the last bytes kept for receivers resuming with Range.
+	// Receivers can resume within ResumeTimeout when both are set.
+	ReplayBufferSize int
+	// ProgressInterval is the interval of progress sent to senders with "?progress=1" or "Accept: text/event-stream".
+	// Zero means one second.
+	ProgressInterval time.Duration
+	// SenderAuth authenticates senders if not nil
+	SenderAuth *Auth
+	// ReceiverAuth authenticates receivers if not nil
+	ReceiverAuth *Auth
+	// Policy controls access to paths if not nil
+	Policy *Policy
+	// RateLimit is the maximum bytes per second of all transfers. Zero means no limit.
+	RateLimit int64
+	// TransferRateLimit is the maximum bytes per second of each transfer. Zero means no limit.
+	// A sender can lower the rate with the "rate" query parameter.
+	TransferRateLimit int64
+	// IPRateLimit is the maximum bytes per second of transfers from the same sender IP address. Zero means no limit.
+	IPRateLimit int64
+	// MaxBodySize is the maximum body size of a sender in bytes. Zero means no limit.
+	MaxBodySize int64
+	// IPDailyQuota is the maximum bytes sent from the same IP address per day in UTC. Zero means no limit.
+	IPDailyQuota int64
+	// CredentialDailyQuota is the maximum bytes sent with the same credential per day in UTC. Zero means no limit.
+	CredentialDailyQuota int64
+	// QuotaSnapshotPath is the file where the usage of daily quotas is saved after each transfer if not empty.
+	// LoadQuotaSnapshot() restores the usage.
+	QuotaSnapshotPath string
+	// Hooks is called on the lifecycle of transfers if not nil
+	Hooks Hooks
+	// Registry locates the node of each path in a cluster. Nil means all paths are on this node.
+	Registry Registry
+	// ForwardedHeaders are headers forwarded from a sender to receivers in addition to Content-Type, Content-Length,
+	// Content-Disposition, Content-Encoding and X-Piping. A name ending with "*" matches headers with the prefix (e.g. "X-Meta-*").
+	// Hop-by-hop and security-sensitive headers such as Connection and Cookie are never forwarded.
+	ForwardedHeaders []string
+	// BlockedHeaders are headers not forwarded even if they are in ForwardedHeaders
+	BlockedHeaders []string
+	// NegotiateContentEncoding compresses bodies with zstd or gzip for receivers accepting them
+	// and decompresses bodies for receivers not accepting the Content-Encoding of the sender
+	NegotiateContentEncoding bool
+	// DigestAlgorithm is the algorithm of the digest of each body in DigestAlgorithms() if not empty.
+	// The digest is sent to receivers in a Repr-Digest trailer and to the sender as an "[INFO] sha256=..." line.
+	DigestAlgorithm string
+	// StoreDir is the directory where bodies of senders with the "store" query parameter (e.g. store=1h) are kept
+	// until a receiver gets them. Empty disables store-and-forward. PrepareStoreDir() creates it.
+	StoreDir string
+	// StoreMaxTTL is the maximum duration in the "store" query parameter (0 means no limit)
+	StoreMaxTTL time.Duration
+	// StoreMaxSize is the maximum bytes of each stored body (0 means no limit)
+	StoreMaxSize int64
+	// StoreMaxTotalSize is the maximum bytes of all stored bodies (0 means no limit)
+	StoreMaxTotalSize int64
+	// BroadcastReplaySize is the number of the last bytes of a broadcast kept for receivers joining with the "replay" query parameter (0 disables)
+	BroadcastReplaySize int
+	// AdminAuth authenticates requests to AdminHandler() if not nil
+	AdminAuth *Auth
+	// AdminHashPaths hides paths in AdminHandler() and shows only their IDs
+	AdminHashPaths bool
 }
 
 type PipingServer struct {
-	pathToPipe syncmap.SyncMap[string, *pipe]
-	logger     *log.Logger
+	// NOTE: Fields of Config can be changed before serving
+	Config
+
+	pathToPipe      syncmap.SyncMap[string, *pipe]
+	pathToBroadcast syncmap.SyncMap[string, *broadcast]
+	logger          *slog.Logger
+	metrics         *metrics
+	rateLimiters    *rateLimiters
+	quotas          *quotas
+	store           *store
+	// NOTE: true after Shutdown() is called
+	isShuttingDown atomic.Bool
+	// NOTE: closed when Shutdown() is called
+	shuttingDownCh chan struct{}
+	// NOTE: random key of IDs of pipes in the admin API
+	pipeIDKey []byte
 }
 
-func isReservedPath(path string) bool {
+func (s *PipingServer) isReservedPath(path string) bool {
+	if handler, ok := s.ReservedPathHandlers[path]; ok {
+		return handler != nil
+	}
 	for _, p := range reservedPaths {
 		if p == path {
 			return true
@@ -54,30 +187,279 @@ func isReservedPath(path string) bool {
 	return false
 }
 
+func (s *PipingServer) isMethodAllowed(method string) bool {
+	if s.AllowedMethods == nil {
+		return true
+	}
+	for _, m := range s.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// setAllowOrigin sets Access-Control-Allow-Origin if the origin of the request is allowed
+func (s *PipingServer) setAllowOrigin(header http.Header, req *http.Request) {
+	if s.CORSAllowedOrigins == nil {
+		header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	header.Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	for _, o := range s.CORSAllowedOrigins {
+		if o == "*" || o == origin {
+			header.Set("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+}
+
+// writeSenderResponseHeader sends the status code and the header to the sender without waiting for the body to be read
+func (s *PipingServer) writeSenderResponseHeader(resWriter http.ResponseWriter, req *http.Request, statusCode int) {
+	contentLength := req.ContentLength
+	// NOTE: `req.ContentLength = 0` is a workaround for full duplex
+	// Replace with https://github.com/golang/go/blob/457fd1d52d17fc8e73d4890150eadab3128de64d/src/net/http/responsecontroller.go#L119-L141 in the future
+	req.ContentLength = 0
+	s.setAllowOrigin(resWriter.Header(), req)
+	setSenderResponseHeader(resWriter.Header(), req)
+	resWriter.WriteHeader(statusCode)
+	if f, ok := resWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	req.ContentLength = contentLength
+}
+
+// respondError responds the error message such as "[ERROR] ...\n" with the status code
+func (s *PipingServer) respondError(resWriter http.ResponseWriter, req *http.Request, statusCode int, message string) {
+	s.setAllowOrigin(resWriter.Header(), req)
+	resWriter.WriteHeader(statusCode)
+	resWriter.Write([]byte(message))
+}
+
+// NewServer creates a Piping Server logging to *log.Logger
 func NewServer(logger *log.Logger) *PipingServer {
+	return NewServerWithLogHandler(newLogLoggerHandler(logger))
+}
+
+// NewServerWithLogHandler creates a Piping Server emitting structured logs to the handler
+func NewServerWithLogHandler(handler slog.Handler) *PipingServer {
+	return NewServerWithConfig(Config{LogHandler: handler})
+}
+
+// NewServerWithConfig creates a Piping Server with the configuration
+func NewServerWithConfig(config Config) *PipingServer {
+	logHandler := config.LogHandler
+	if logHandler == nil {
+		logHandler = slog.Default().Handler()
+	}
+	pipeIDKey := make([]byte, 32)
+	if _, err := rand.Read(pipeIDKey); err != nil {
+		panic(err)
+	}
 	return &PipingServer{
+		Config:     config,
 		pathToPipe: syncmap.SyncMap[string, *pipe]{},
-		logger:     logger,
+		logger:     slog.New(logHandler),
+		metrics:    newMetrics(),
+		rateLimiters: &rateLimiters{
+			ipToLimiter: map[string]*ipRateLimiter{},
+		},
+		quotas:         newQuotas(),
+		store:          newStore(),
+		shuttingDownCh: make(chan struct{}),
+		pipeIDKey:      pipeIDKey,
 	}
 }
 
+// ServeHTTP serves Handler() under PathPrefix
+func (s *PipingServer) ServeHTTP(resWriter http.ResponseWriter, req *http.Request) {
+	prefix := strings.TrimSuffix(s.PathPrefix, "/")
+	if prefix == "" {
+		s.Handler(resWriter, req)
+		return
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, prefix)
+	if !ok || (path != "" && !strings.HasPrefix(path, "/")) {
+		http.NotFound(resWriter, req)
+		return
+	}
+	// Redirect to the top page with a trailing slash to resolve relative links in the page
+	if path == "" && (req.Method == "GET" || req.Method == "HEAD") {
+		http.Redirect(resWriter, req, prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	// NOTE: Unlike http.StripPrefix(), the request is not cloned because the workaround for full duplex changes req.ContentLength seen by net/http
+	originalURL := req.URL
+	strippedURL := *req.URL
+	strippedURL.Path = path
+	strippedURL.RawPath = strings.TrimPrefix(req.URL.RawPath, prefix)
+	req.URL = &strippedURL
+	defer func() { req.URL = originalURL }()
+	s.Handler(resWriter, req)
+}
+
+// getPipe returns the locked pipe on the path
 func (s *PipingServer) getPipe(path string) *pipe {
-	pi := &pipe{
-		receiverResWriterCh: make(chan http.ResponseWriter, 1),
-		sendFinishedCh:      make(chan struct{}),
-		isSenderConnected:   0,
+	for {
+		pi := &pipe{
+			receiversChangedCh: make(chan struct{}, 1),
+			createdAt:          time.Now(),
+			canceledCh:         make(chan struct{}),
+		}
+		pi, loaded := s.pathToPipe.LoadOrStore(path, pi)
+		if !loaded {
+			s.metrics.activePipes.Add(1)
+			s.logger.Debug("pipe created", "path", path)
+		}
+		pi.mu.Lock()
+		// NOTE: The pipe may be closed between LoadOrStore() and Lock()
+		if !pi.isClosed {
+			return pi
+		}
+		pi.mu.Unlock()
+	}
+}
+
+// waitContext returns a context canceled when WaitTimeout passes
+func (s *PipingServer) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.WaitTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.WaitTimeout)
+}
+
+// closeLocked removes the pipe from the server. pi.mu should be locked.
+func (s *PipingServer) closeLocked(path string, pi *pipe) {
+	if pi.isClosed {
+		return
+	}
+	pi.isClosed = true
+	s.pathToPipe.Delete(path)
+	s.metrics.activePipes.Add(-1)
+}
+
+// closeIfUnusedLocked removes the pipe if no one uses it. pi.mu should be locked.
+func (s *PipingServer) closeIfUnusedLocked(path string, pi *pipe) {
+	if !pi.isSenderConnected && len(pi.receivers) == 0 {
+		s.closeLocked(path, pi)
+	}
+}
+
+// releaseWaitingReceiver removes the receiver from the pipe and returns true if the transfer has not started
+func (s *PipingServer) releaseWaitingReceiver(path string, pi *pipe, rcv *receiver) bool {
+	pi.mu.Lock()
+	if pi.isTransferring {
+		pi.mu.Unlock()
+		return false
+	}
+	pi.removeReceiverLocked(rcv)
+	s.metrics.waitingReceivers.Add(-1)
+	s.closeIfUnusedLocked(path, pi)
+	pi.mu.Unlock()
+	pi.notifyReceiversChanged()
+	return true
+}
+
+// removeReceiverLocked removes the receiver from the pipe. pi.mu should be locked.
+func (pi *pipe) removeReceiverLocked(rcv *receiver) {
+	for i, r := range pi.receivers {
+		if r == rcv {
+			pi.receivers = append(pi.receivers[:i], pi.receivers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (pi *pipe) notifyReceiversChanged() {
+	select {
+	case pi.receiversChangedCh <- struct{}{}:
+	default:
 	}
-	pi, _ = s.pathToPipe.LoadOrStore(path, pi)
-	return pi
 }
 
-func transferHeaderIfExists(w http.ResponseWriter, reqHeader textproto.MIMEHeader, header string) {
+// getNReceivers parses the "n" query parameter
+func getNReceivers(req *http.Request) (int, error) {
+	nStr := req.URL.Query().Get("n")
+	if nStr == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil {
+		return 0, errors.New("[ERROR] Invalid \"n\" query parameter\n")
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("[ERROR] n should > 0, but n = %d.\n", n)
+	}
+	return n, nil
+}
+
+func transferHeaderIfExists(h http.Header, reqHeader textproto.MIMEHeader, header string) {
 	values := reqHeader.Values(header)
 	if len(values) == 1 {
-		w.Header().Add(header, values[0])
+		h.Add(header, values[0])
+	}
+}
+
+// waitForReceivers waits until all receivers are connected and starts transferring
+func (s *PipingServer) waitForReceivers(ctx context.Context, pi *pipe, nReceivers int, resWriteFlusher io.Writer) ([]*receiver, error) {
+	if _, err := resWriteFlusher.Write([]byte(fmt.Sprintf("[INFO] Waiting for %d receiver(s)...\n", nReceivers))); err != nil {
+		return nil, err
+	}
+	nNotified := 0
+	for {
+		pi.mu.Lock()
+		nConnected := len(pi.receivers)
+		pi.mu.Unlock()
+		// NOTE: Some receivers may have been disconnected
+		if nNotified > nConnected {
+			nNotified = nConnected
+		}
+		for ; nNotified < nConnected; nNotified++ {
+			if _, err := resWriteFlusher.Write([]byte("[INFO] A receiver was connected.\n")); err != nil {
+				return nil, err
+			}
+		}
+		pi.mu.Lock()
+		if len(pi.receivers) == nReceivers {
+			pi.isTransferring = true
+			s.metrics.waitingReceivers.Add(int64(-nReceivers))
+			receivers := append([]*receiver(nil), pi.receivers...)
+			pi.mu.Unlock()
+			return receivers, nil
+		}
+		pi.mu.Unlock()
+		select {
+		case <-pi.receiversChangedCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pi.canceledCh:
+			return nil, errPipeCanceled
+		case <-s.shuttingDownCh:
+			return nil, errShuttingDown
+		}
 	}
 }
 
+// watchReceiversDisconnected returns a channel closed when any of the receivers is disconnected
+func watchReceiversDisconnected(receivers []*receiver, finishedCh <-chan struct{}) <-chan struct{} {
+	disconnectedCh := make(chan struct{})
+	var once sync.Once
+	for _, rcv := range receivers {
+		go func(rcv *receiver) {
+			select {
+			case <-rcv.req.Context().Done():
+				once.Do(func() { close(disconnectedCh) })
+			case <-finishedCh:
+			}
+		}(rcv)
+	}
+	return disconnectedCh
+}
+
 func getTransferHeaderAndBody(req *http.Request) (textproto.MIMEHeader, io.ReadCloser) {
 	mediaType, params, mediaTypeParseErr := mime.ParseMediaType(req.Header.Get("Content-Type"))
 	// If multipart upload
@@ -93,31 +475,51 @@ func getTransferHeaderAndBody(req *http.Request) (textproto.MIMEHeader, io.ReadC
 	return textproto.MIMEHeader(req.Header), req.Body
 }
 
+// getSenderTransferHeaderAndBody returns the header and the body sent to receivers, which are encrypted if encryptor is not nil
+func getSenderTransferHeaderAndBody(req *http.Request, encryptor *encryptingReader) (textproto.MIMEHeader, io.ReadCloser) {
+	transferHeader, transferBody := getTransferHeaderAndBody(req)
+	if encryptor == nil {
+		return transferHeader, transferBody
+	}
+	encryptor.reader = transferBody
+	return textproto.MIMEHeader{
+		"Content-Type":        {"application/octet-stream"},
+		"Content-Disposition": transferHeader.Values("Content-Disposition"),
+	}, io.NopCloser(encryptor)
+}
+
 func (s *PipingServer) Handler(resWriter http.ResponseWriter, req *http.Request) {
-	s.logger.Printf("%s %s %s", req.Method, req.URL, req.Proto)
+	s.trustForwardedRequest(req)
+	s.logger.Info("request", "method", req.Method, "url", redactedURL(req.URL), "proto", req.Proto, "remote_addr", req.RemoteAddr)
+	s.metrics.observeRequest(req)
 	path := req.URL.Path
 
-	if req.Method == "GET" || req.Method == "HEAD" {
+	handler, overridden := s.ReservedPathHandlers[path]
+	if handler != nil {
+		handler.ServeHTTP(resWriter, req)
+		return
+	}
+	if (req.Method == "GET" || req.Method == "HEAD") && !overridden {
 		switch path {
 		case reservedPathIndex:
 			indexPageBytes := []byte(indexPage)
 			resWriter.Header().Set("Content-Type", "text/html")
 			resWriter.Header().Set("Content-Length", strconv.Itoa(len(indexPageBytes)))
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+			s.setAllowOrigin(resWriter.Header(), req)
 			resWriter.Write(indexPageBytes)
 			return
 		case reservedPathNoScript:
 			noScriptHtmlBytes := []byte(noScriptHtml(req.URL.Query().Get(noscriptPathQueryParameterName)))
 			resWriter.Header().Set("Content-Type", "text/html")
 			resWriter.Header().Set("Content-Length", strconv.Itoa(len(noScriptHtmlBytes)))
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+			s.setAllowOrigin(resWriter.Header(), req)
 			resWriter.Write(noScriptHtmlBytes)
 			return
 		case reservedPathVersion:
 			versionBytes := []byte(fmt.Sprintf("%s in Go\n", version.Version))
 			resWriter.Header().Set("Content-Type", "text/plain")
 			resWriter.Header().Set("Content-Length", strconv.Itoa(len(versionBytes)))
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+			s.setAllowOrigin(resWriter.Header(), req)
 			resWriter.Write(versionBytes)
 			return
 		case reservedPathHelp:
@@ -125,11 +527,11 @@ func (s *PipingServer) Handler(resWriter http.ResponseWriter, req *http.Request)
 			if req.TLS != nil {
 				protocol = "https"
 			}
-			url := fmt.Sprintf(protocol+"://%s", req.Host)
+			url := fmt.Sprintf(protocol+"://%s%s", req.Host, strings.TrimSuffix(s.PathPrefix, "/"))
 			helpPageBytes := []byte(helpPage(url))
 			resWriter.Header().Set("Content-Type", "text/plain")
 			resWriter.Header().Set("Content-Length", strconv.Itoa(len(helpPageBytes)))
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
+			s.setAllowOrigin(resWriter.Header(), req)
 			resWriter.Write(helpPageBytes)
 			return
 		case reservedPathFaviconIco:
@@ -140,126 +542,344 @@ func (s *PipingServer) Handler(resWriter http.ResponseWriter, req *http.Request)
 			resWriter.Header().Set("Content-Length", "0")
 			resWriter.WriteHeader(404)
 			return
+		case reservedPathMetrics:
+			metricsBytes := []byte(s.metrics.text())
+			resWriter.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			resWriter.Header().Set("Content-Length", strconv.Itoa(len(metricsBytes)))
+			resWriter.Write(metricsBytes)
+			return
 		}
 	}
 
-	// TODO: should close if either sender or receiver closes
+	if !s.isMethodAllowed(req.Method) {
+		s.rejectUnsupportedMethod(resWriter, req)
+		return
+	}
+	if (req.Method == "GET" || req.Method == "POST" || req.Method == "PUT") && !s.isReservedPath(path) && s.proxyIfRemote(resWriter, req) {
+		return
+	}
 	switch req.Method {
 	case "GET":
 		// If the receiver requests Service Worker registration
 		// (from: https://speakerdeck.com/masatokinugawa/pwa-study-sw?slide=32)
 		if req.Header.Get("Service-Worker") == "script" {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte("[ERROR] Service Worker registration is rejected.\n"))
+			s.metrics.observeRejection(rejectReasonServiceWorker)
+			s.respondError(resWriter, req, 400, "[ERROR] Service Worker registration is rejected.\n")
+			return
+		}
+		if _, ok := s.authenticate(s.ReceiverAuth, resWriter, req); !ok {
+			return
+		}
+		nReceivers, err := getNReceivers(req)
+		if err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidNReceivers)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		mode, err := getMode(req)
+		if err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidMode)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		rule, _, ok := s.checkPolicy(resWriter, req, nReceivers)
+		if !ok {
+			return
+		}
+		if !s.authorize(resWriter, req, RoleReceiver) {
+			return
+		}
+		// If the receiver resumes the transfer
+		if len(req.Header.Values("Range")) != 0 && s.resumeReceiving(path, resWriter, req) {
+			break
+		}
+		// If a body is stored for the receiver
+		if nReceivers == 1 && s.sendStoredBody(path, resWriter, req) {
+			break
+		}
+		maxReceivers := 0
+		if rule != nil {
+			maxReceivers = rule.MaxReceivers
+		}
+		if s.receiveBroadcast(path, resWriter, req, mode, maxReceivers) {
+			break
+		}
+		if s.rejectNewPipeIfShuttingDown(resWriter, req, path) {
 			return
 		}
 		pi := s.getPipe(path)
-		// If already get the path or transferring
-		if len(pi.receiverResWriterCh) != 0 || atomic.LoadUint32(&pi.isTransferring) == 1 {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte("[ERROR] The number of receivers has reached limits.\n"))
+		// NOTE: A sender may store a body after sendStoredBody() returns false.
+		// The store is checked after entering the pipe because the sender does not store the body if the pipe exists.
+		isStoredBodySent := false
+		for nReceivers == 1 && s.isBodyStored(path) {
+			s.closeIfUnusedLocked(path, pi)
+			pi.mu.Unlock()
+			if isStoredBodySent = s.sendStoredBody(path, resWriter, req); isStoredBodySent {
+				break
+			}
+			pi = s.getPipe(path)
+		}
+		if isStoredBodySent {
+			break
+		}
+		// If already transferring or all receivers have been connected
+		if pi.isTransferring || (pi.nReceivers == nReceivers && len(pi.receivers) == nReceivers) {
+			pi.mu.Unlock()
+			s.metrics.observeRejection(rejectReasonReceiverLimit)
+			s.respondError(resWriter, req, 400, "[ERROR] The number of receivers has reached limits.\n")
+			return
+		}
+		if pi.nReceivers != 0 && pi.nReceivers != nReceivers {
+			expectedNReceivers := pi.nReceivers
+			pi.mu.Unlock()
+			s.metrics.observeRejection(rejectReasonMismatchedNReceivers)
+			s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] The number of receivers should be %d but %d.\n", expectedNReceivers, nReceivers))
 			return
 		}
-		pi.receiverResWriterCh <- resWriter
+		rcv := &receiver{resWriter: resWriter, req: req, doneCh: make(chan struct{})}
+		pi.nReceivers = nReceivers
+		pi.receivers = append(pi.receivers, rcv)
+		s.metrics.waitingReceivers.Add(1)
+		pi.mu.Unlock()
+		s.logger.Info("receiver connected", "path", path, "remote_addr", req.RemoteAddr, "n_receivers", nReceivers)
+		s.hooks().OnReceiverConnected(req)
+		pi.notifyReceiversChanged()
+		waitCtx, cancelWait := s.waitContext(req.Context())
+		defer cancelWait()
 		// Wait for finish
-		<-pi.sendFinishedCh
+		select {
+		case <-rcv.doneCh:
+		case <-waitCtx.Done():
+			// If the receiver is disconnected or timed out before transferring
+			if s.releaseWaitingReceiver(path, pi, rcv) {
+				if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+					s.respondError(resWriter, req, 408, fmt.Sprintf("[ERROR] Timed out waiting for a sender for %s.\n", s.WaitTimeout))
+				}
+				return
+			}
+			// NOTE: resWriter should not be released until the sender finishes using it
+			<-rcv.doneCh
+		case <-pi.canceledCh:
+			if s.releaseWaitingReceiver(path, pi, rcv) {
+				s.respondError(resWriter, req, 410, "[ERROR] The pipe was canceled by the administrator.\n")
+				return
+			}
+			<-rcv.doneCh
+		case <-s.shuttingDownCh:
+			if s.releaseWaitingReceiver(path, pi, rcv) {
+				s.respondError(resWriter, req, 503, shuttingDownMessage)
+				return
+			}
+			<-rcv.doneCh
+		}
+		if rcv.transferErr != nil {
+			// Abort not to make the receiver regard the partial body as complete
+			panic(http.ErrAbortHandler)
+		}
 	case "POST", "PUT":
 		// If reserved path
-		if isReservedPath(path) {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Cannot send to the reserved path '%s'. (e.g. '/mypath123')\n", path)))
+		if s.isReservedPath(path) {
+			s.metrics.observeRejection(rejectReasonReservedPath)
+			s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] Cannot send to the reserved path '%s'. (e.g. '/mypath123')\n", path))
 			return
 		}
-		// Notify that Content-Range is not supported
-		// In the future, resumable upload using Content-Range might be supported
-		// ref: https://github.com/httpwg/http-core/pull/653
-		if len(req.Header.Values("Content-Range")) != 0 {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Content-Range is not supported for now in %s\n", req.Method)))
+		identity, ok := s.authenticate(s.SenderAuth, resWriter, req)
+		if !ok {
 			return
 		}
-		pi := s.getPipe(path)
-		// If a sender is already connected
-		if !atomic.CompareAndSwapUint32(&pi.isSenderConnected, 0, 1) {
-			resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-			resWriter.WriteHeader(400)
-			reqContentLength := req.ContentLength
-			// NOTE: `req.ContentLength = 0` is a workaround for full duplex
-			// Replace with https://github.com/golang/go/blob/457fd1d52d17fc8e73d4890150eadab3128de64d/src/net/http/responsecontroller.go#L119-L141 in the future
-			req.ContentLength = 0
-			if f, ok := resWriter.(http.Flusher); ok {
-				f.Flush()
+		nReceivers, err := getNReceivers(req)
+		if err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidNReceivers)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		if _, err := getRate(req); err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidRate)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		mode, err := getMode(req)
+		if err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidMode)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		passphrase, encrypts, err := getEncryptionPassphrase(req)
+		if err != nil {
+			s.metrics.observeRejection(rejectReasonInvalidEncryption)
+			s.respondError(resWriter, req, 400, err.Error())
+			return
+		}
+		rule, policyIdentity, ok := s.checkPolicy(resWriter, req, nReceivers)
+		if !ok {
+			return
+		}
+		if !s.authorize(resWriter, req, RoleSender) {
+			return
+		}
+		if policyIdentity != "" {
+			identity = policyIdentity
+		}
+		maxBodySize := s.MaxBodySize
+		if rule != nil && rule.MaxBodySize != 0 && (maxBodySize == 0 || rule.MaxBodySize < maxBodySize) {
+			maxBodySize = rule.MaxBodySize
+		}
+		if maxBodySize != 0 {
+			if req.ContentLength > maxBodySize {
+				s.metrics.observeRejection(rejectReasonBodyTooLarge)
+				s.respondError(resWriter, req, 413, fmt.Sprintf("[ERROR] The body should be <= %d bytes on '%s', but %d bytes.\n", maxBodySize, path, req.ContentLength))
+				return
+			}
+			// Abort the transfer when the body exceeds the limit without Content-Length
+			req.Body = http.MaxBytesReader(resWriter, req.Body, maxBodySize)
+		}
+		if s.IPDailyQuota > 0 || s.CredentialDailyQuota > 0 {
+			ip := remoteIP(req)
+			if quota := s.exceededQuota(ip, identity, req.ContentLength); quota != 0 {
+				s.metrics.observeRejection(rejectReasonQuotaExceeded)
+				s.respondError(resWriter, req, 429, fmt.Sprintf("[ERROR] %s\n", &quotaExceededError{quota: quota}))
+				return
+			}
+			req.Body = &quotaReadCloser{quotaReader: quotaReader{server: s, reader: req.Body, ip: ip, identity: identity}, closer: req.Body}
+			defer s.saveQuotaSnapshot()
+		}
+		var encryptor *encryptingReader
+		if encrypts {
+			if len(req.Header.Values("Content-Range")) != 0 {
+				s.metrics.observeRejection(rejectReasonInvalidEncryption)
+				s.respondError(resWriter, req, 400, "[ERROR] An encrypted transfer cannot be resumed.\n")
+				return
+			}
+			encryptor, err = newEncryptingReader(passphrase)
+			if err != nil {
+				s.respondError(resWriter, req, 500, "[ERROR] Failed to start encryption.\n")
+				return
 			}
-			req.ContentLength = reqContentLength
-			resWriter.Write([]byte(fmt.Sprintf("[ERROR] Another sender has been connected on '%s'.\n", path)))
+		}
+		if mode == modeBroadcast {
+			// NOTE: Receivers of a broadcast are not limited without "n" query parameter or the policy
+			maxReceivers := 0
+			if req.URL.Query().Has("n") {
+				maxReceivers = nReceivers
+			} else if rule != nil {
+				maxReceivers = rule.MaxReceivers
+			}
+			s.startBroadcast(path, resWriter, req, encryptor, maxReceivers)
 			return
 		}
-
-		contentLength := req.ContentLength
-		// NOTE: `req.ContentLength = 0` is a workaround for full duplex
-		// Replace with https://github.com/golang/go/blob/457fd1d52d17fc8e73d4890150eadab3128de64d/src/net/http/responsecontroller.go#L119-L141 in the future
-		req.ContentLength = 0
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		resWriter.WriteHeader(200)
-		if f, ok := resWriter.(http.Flusher); ok {
-			f.Flush()
+		if req.URL.Query().Has(storeQueryName) && s.storeBody(path, resWriter, req, nReceivers, encryptor) {
+			return
 		}
-		req.ContentLength = contentLength
-
-		resWriteFlusher := NewWriteFlusherIfPossible(resWriter)
-		if _, err := resWriteFlusher.Write([]byte("[INFO] Waiting for 1 receiver(s)...\n")); err != nil {
+		if len(req.Header.Values("Content-Range")) != 0 {
+			// Notify that Content-Range is not supported without resumable uploads
+			// ref: https://github.com/httpwg/http-core/pull/653
+			if s.ResumeTimeout <= 0 {
+				s.metrics.observeRejection(rejectReasonUnsupportedContentRange)
+				s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] Content-Range is not supported for now in %s\n", req.Method))
+				return
+			}
+			if !s.resumeTransfer(path, resWriter, req, maxBodySize) {
+				return
+			}
+			break
+		}
+		if s.rejectNewPipeIfShuttingDown(resWriter, req, path) {
 			return
 		}
-		receiverResWriter := <-pi.receiverResWriterCh
-		if _, err := resWriteFlusher.Write([]byte("[INFO] A receiver was connected.\n")); err != nil {
+		if _, ok := s.pathToBroadcast.Load(path); ok {
+			s.metrics.observeRejection(rejectReasonDuplicateSender)
+			s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] '%s' is used for a broadcast.\n", path))
 			return
 		}
-		if _, err := resWriteFlusher.Write([]byte("[INFO] Start sending to 1 receiver(s)!\n")); err != nil {
+		pi := s.getPipe(path)
+		// If a sender is already connected
+		if pi.isSenderConnected {
+			pi.mu.Unlock()
+			s.metrics.observeRejection(rejectReasonDuplicateSender)
+			s.writeSenderResponseHeader(resWriter, req, 400)
+			newSenderWriter(resWriter, req).Write([]byte(fmt.Sprintf("[ERROR] Another sender has been connected on '%s'.\n", path)))
 			return
 		}
-		atomic.StoreUint32(&pi.isTransferring, 1)
-		transferHeader, transferBody := getTransferHeaderAndBody(req)
-		receiverResWriter.Header()["Content-Type"] = nil // not to sniff
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Type")
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Length")
-		transferHeaderIfExists(receiverResWriter, transferHeader, "Content-Disposition")
-		xPipingValues := req.Header.Values("X-Piping")
-		if len(xPipingValues) != 0 {
-			receiverResWriter.Header()["X-Piping"] = xPipingValues
+		if pi.nReceivers != 0 && pi.nReceivers != nReceivers {
+			expectedNReceivers := pi.nReceivers
+			pi.mu.Unlock()
+			s.metrics.observeRejection(rejectReasonMismatchedNReceivers)
+			s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] The number of receivers should be %d but %d.\n", expectedNReceivers, nReceivers))
+			return
 		}
-		receiverResWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		if len(xPipingValues) != 0 {
-			receiverResWriter.Header().Set("Access-Control-Expose-Headers", "X-Piping")
+		pi.isSenderConnected = true
+		pi.senderReq = req
+		pi.nReceivers = nReceivers
+		// NOTE: An encrypted transfer can not be resumed
+		if s.ResumeTimeout > 0 && encryptor == nil {
+			pi.resumeToken = newResumeToken()
+			setResumeTokenHeader(resWriter.Header(), pi.resumeToken)
 		}
-		receiverResWriter.Header().Set("X-Robots-Tag", "none")
-		receiverResWriteFlusher := NewWriteFlusherIfPossible(receiverResWriter)
-		if _, err := io.Copy(receiverResWriteFlusher, transferBody); err != nil {
+		pi.mu.Unlock()
+		s.logger.Info("sender connected", "path", path, "remote_addr", req.RemoteAddr, "n_receivers", nReceivers)
+		s.hooks().OnSenderConnected(req)
+
+		s.writeSenderResponseHeader(resWriter, req, 200)
+
+		resWriteFlusher := newSenderWriter(resWriter, req)
+		waitCtx, cancelWait := s.waitContext(req.Context())
+		s.metrics.waitingSenders.Add(1)
+		receivers, err := s.waitForReceivers(waitCtx, pi, nReceivers, resWriteFlusher)
+		s.metrics.waitingSenders.Add(-1)
+		cancelWait()
+		if err != nil {
+			pi.mu.Lock()
+			pi.isSenderConnected = false
+			pi.senderReq = nil
+			pi.resumeToken = ""
+			s.closeIfUnusedLocked(path, pi)
+			pi.mu.Unlock()
+			if errors.Is(err, context.DeadlineExceeded) {
+				resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] Timed out waiting for %d receiver(s) for %s.\n", nReceivers, s.WaitTimeout)))
+			}
+			if errors.Is(err, errPipeCanceled) {
+				resWriteFlusher.Write([]byte("[ERROR] The pipe was canceled by the administrator.\n"))
+			}
+			if errors.Is(err, errShuttingDown) {
+				resWriteFlusher.Write([]byte(shuttingDownMessage))
+			}
+			return
+		}
+		transferHeader, transferBody := getSenderTransferHeaderAndBody(req, encryptor)
+		t := s.startTransfer(path, pi, req, receivers, transferHeader)
+		s.logger.Info("transfer started", "path", path, "sender_addr", req.RemoteAddr, "receiver_addrs", t.info.ReceiverAddrs)
+		s.hooks().OnTransferStart(t.info)
+		if _, err := resWriteFlusher.Write([]byte(fmt.Sprintf("[INFO] Start sending to %d receiver(s)!\n", nReceivers))); err != nil {
+			s.finishTransfer(path, pi, t, err)
 			return
 		}
-		if _, err := resWriteFlusher.Write([]byte("[INFO] Sent successfully!\n")); err != nil {
+		if err := s.runTransfer(path, pi, t, resWriter, req, transferBody, resWriteFlusher); err != nil {
 			return
 		}
-		pi.sendFinishedCh <- struct{}{}
-		s.pathToPipe.Delete(path)
 	case "OPTIONS":
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		resWriter.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
-		resWriter.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Disposition, X-Piping")
+		s.setAllowOrigin(resWriter.Header(), req)
+		allowMethods := "GET, HEAD, POST, PUT, OPTIONS"
+		if s.AllowedMethods != nil {
+			allowMethods = strings.Join(s.AllowedMethods, ", ")
+		}
+		resWriter.Header().Set("Access-Control-Allow-Methods", allowMethods)
+		allowHeaders := "Content-Type, Content-Disposition, Content-Encoding, X-Piping, X-Piping-Encryption"
+		if s.SenderAuth != nil || s.ReceiverAuth != nil || s.Policy != nil {
+			allowHeaders += ", Authorization"
+		}
+		for _, name := range s.allowedForwardedRequestHeaders(req) {
+			allowHeaders += ", " + name
+		}
+		resWriter.Header().Set("Access-Control-Allow-Headers", allowHeaders)
 		resWriter.Header().Set("Access-Control-Max-Age", "86400")
 		resWriter.Header().Set("Content-Length", "0")
 		resWriter.WriteHeader(200)
 		return
 	default:
-		resWriter.WriteHeader(405)
-		resWriter.Header().Set("Access-Control-Allow-Origin", "*")
-		resWriter.Write([]byte(fmt.Sprintf("[ERROR] Unsupported method: %s.\n", req.Method)))
+		s.rejectUnsupportedMethod(resWriter, req)
 		return
 	}
-	s.logger.Printf("Transferring %s has finished in %s method.\n", req.URL.Path, req.Method)
+	s.logger.Info("request finished", "method", req.Method, "path", req.URL.Path, "remote_addr", req.RemoteAddr)
 }
 
 type WriteFlusher struct {
@@ -282,3 +902,8 @@ func (f *WriteFlusher) Write(p []byte) (int, error) {
 	f.flusher.Flush()
 	return n, err
 }
+
+func (s *PipingServer) rejectUnsupportedMethod(resWriter http.ResponseWriter, req *http.Request) {
+	s.metrics.observeRejection(rejectReasonUnsupportedMethod)
+	s.respondError(resWriter, req, 405, fmt.Sprintf("[ERROR] Unsupported method: %s.\n", req.Method))
+}
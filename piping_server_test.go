@@ -1,23 +1,48 @@
 package piping_server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/nwtgck/go-piping-server/version"
+	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/net/context"
 	"gotest.tools/v3/assert"
 	"io"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // serve serves Piping Server on available port
 func serve(t *testing.T) (*http.Server, string) {
 	logger := log.New(io.Discard, "", log.LstdFlags|log.Lmicroseconds)
-	pipingServer := NewServer(logger)
+	return servePipingServer(t, NewServer(logger))
+}
+
+// servePipingServer serves the given Piping Server on available port
+func servePipingServer(t *testing.T, pipingServer *PipingServer) (*http.Server, string) {
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
@@ -168,7 +193,7 @@ func TestPreflightRequest(t *testing.T) {
 	assert.Equal(t, res.StatusCode, 200)
 	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "*")
 	assert.Equal(t, res.Header.Get("Access-Control-Allow-Methods"), "GET, HEAD, POST, PUT, OPTIONS")
-	assert.Equal(t, strings.ToLower(res.Header.Get("Access-Control-Allow-Headers")), "content-type, content-disposition, x-piping")
+	assert.Equal(t, strings.ToLower(res.Header.Get("Access-Control-Allow-Headers")), "content-type, content-disposition, content-encoding, x-piping, x-piping-encryption")
 	assert.Equal(t, res.Header.Get("Access-Control-Max-Age"), "86400")
 }
 
@@ -359,3 +384,2601 @@ func TestTransferXPipingHeaders(t *testing.T) {
 	assert.Equal(t, receiverRes.Header.Get("Access-Control-Expose-Headers"), "X-Piping")
 	assert.DeepEqual(t, receiverRes.Header.Values("X-Piping"), []string{"mymetadata1", "mymetadata2", "mymetadata3"})
 }
+
+func TestTransferMultipleReceivers(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	nReceivers := 3
+	receiverResChs := make([]chan *http.Response, nReceivers)
+	for i := 0; i < nReceivers; i++ {
+		receiverResCh := make(chan *http.Response)
+		receiverResChs[i] = receiverResCh
+		go func() {
+			res, err := http.Get(url + "/mypath?n=3")
+			if err != nil {
+				t.Error(t)
+				return
+			}
+			receiverResCh <- res
+		}()
+	}
+
+	sendBodyStr := "this is a content"
+	senderReq, err := http.NewRequest("POST", url+"/mypath?n=3", strings.NewReader(sendBodyStr))
+	if err != nil {
+		t.Fatal(t)
+	}
+	senderReq.Header.Set("Content-Type", "text/plain")
+	senderRes, err := http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	senderBody := readerToString(t, senderRes.Body)
+	assert.Assert(t, strings.Contains(senderBody, "[INFO] Waiting for 3 receiver(s)...\n"))
+	assert.Assert(t, strings.Contains(senderBody, "[INFO] Start sending to 3 receiver(s)!\n"))
+
+	for _, receiverResCh := range receiverResChs {
+		receiverRes := <-receiverResCh
+		assert.Equal(t, receiverRes.StatusCode, 200)
+		assert.Equal(t, receiverRes.Header.Get("Content-Type"), "text/plain")
+		assert.Equal(t, readerToString(t, receiverRes.Body), sendBodyStr)
+	}
+}
+
+func TestRejectMismatchedNReceivers(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	senderRes, err := http.Post(url+"/mypath?n=2", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "*")
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The number of receivers should be 2 but 1.\n")
+
+	receiverResCh := make(chan *http.Response)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := http.Get(url + "/mypath?n=2")
+			if err != nil {
+				t.Error(t)
+				return
+			}
+			receiverResCh <- res
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		receiverRes := <-receiverResCh
+		assert.Equal(t, receiverRes.StatusCode, 200)
+		assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	}
+}
+
+func TestRejectInvalidNReceivers(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	for _, n := range []string{"0", "-1", "abc"} {
+		res, err := http.Get(url + "/mypath?n=" + n)
+		if err != nil {
+			t.Fatal(t)
+		}
+		assert.Equal(t, res.StatusCode, 400)
+		assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "*")
+	}
+}
+
+func TestReceiverDisconnectionDuringTransfer(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	senderRes, err := http.Post(url+"/mypath", "text/plain", senderBodyReader)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("hello")); err != nil {
+			t.Error(t)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	receiverReq, err := http.NewRequestWithContext(ctx, "GET", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.DefaultClient.Do(receiverReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.StatusCode, 200)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(t)
+	}
+	cancel()
+
+	senderResBodyReader := bufio.NewReader(senderRes.Body)
+	for {
+		line, err := senderResBodyReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(t)
+		}
+		if line == "[ERROR] receiver disconnected\n" {
+			break
+		}
+	}
+	readerToString(t, senderResBodyReader)
+
+	// The path should be reusable while the sender sends nothing
+	senderRes, err = http.Post(url+"/mypath", "text/plain", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	receiverRes, err = http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "world")
+	senderBodyWriter.Close()
+}
+
+func TestReceiverDisconnectionBeforeTransfer(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	receiverReq, err := http.NewRequestWithContext(ctx, "GET", url+"/mypath?n=2", nil)
+	if err != nil {
+		t.Fatal(t)
+	}
+	go http.DefaultClient.Do(receiverReq)
+	// Wait for the receiver to be connected
+	for {
+		if pi, ok := pipingServer.pathToPipe.Load("/mypath"); ok {
+			pi.mu.Lock()
+			nConnected := len(pi.receivers)
+			pi.mu.Unlock()
+			if nConnected == 1 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	// The path should be released after the receiver is disconnected
+	for {
+		if _, ok := pipingServer.pathToPipe.Load("/mypath"); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+}
+
+func TestReceiverWaitTimeout(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.WaitTimeout = 100 * time.Millisecond
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 408)
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "*")
+	_, ok := pipingServer.pathToPipe.Load("/mypath")
+	assert.Assert(t, !ok)
+}
+
+func TestSenderWaitTimeout(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.WaitTimeout = 100 * time.Millisecond
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	body := readerToString(t, res.Body)
+	assert.Assert(t, strings.HasSuffix(body, "[ERROR] Timed out waiting for 1 receiver(s) for 100ms.\n"))
+	_, ok := pipingServer.pathToPipe.Load("/mypath")
+	assert.Assert(t, !ok)
+}
+
+func TestResumeUpload(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ResumeTimeout = 10 * time.Second
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	senderReq, err := http.NewRequest("POST", url+"/mypath", senderBodyReader)
+	if err != nil {
+		t.Fatal(t)
+	}
+	senderReq.ContentLength = 10
+	senderRes, err := http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	resumeToken := senderRes.Header.Get("X-Piping-Resume-Token")
+	assert.Assert(t, resumeToken != "")
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("hello")); err != nil {
+			t.Error(t)
+		}
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.StatusCode, 200)
+	assert.Equal(t, receiverRes.Header.Get("Content-Length"), "10")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(t)
+	}
+	// Disconnect the sender halfway
+	senderBodyWriter.CloseWithError(errors.New("disconnected"))
+
+	// Ask the offset
+	for {
+		req, err := http.NewRequest("POST", url+"/mypath", nil)
+		if err != nil {
+			t.Fatal(t)
+		}
+		req.Header.Set("Content-Range", "bytes */10")
+		req.Header.Set("X-Piping-Resume-Token", resumeToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(t)
+		}
+		if res.StatusCode == 200 {
+			assert.Equal(t, res.Header.Get("Upload-Offset"), "5")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Range", "bytes 4-9/10")
+	req.Header.Set("X-Piping-Resume-Token", resumeToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 409)
+	assert.Equal(t, res.Header.Get("Upload-Offset"), "5")
+
+	// Another client can not resume the transfer
+	req, err = http.NewRequest("POST", url+"/mypath", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Range", "bytes 5-9/10")
+	req.Header.Set("X-Piping-Resume-Token", "invalid")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] X-Piping-Resume-Token does not match the sender of the transfer on '/mypath'.\n")
+
+	req, err = http.NewRequest("POST", url+"/mypath", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Range", "bytes 5-9/10")
+	req.Header.Set("X-Piping-Resume-Token", resumeToken)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, res.Header.Get("X-Piping-Resume-Token"), resumeToken)
+	assert.Assert(t, strings.HasSuffix(readerToString(t, res.Body), "[INFO] Sent successfully!\n"))
+	assert.Equal(t, string(buf)+readerToString(t, receiverRes.Body), "helloworld")
+}
+
+func TestResumeUploadOverMaxBodySize(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ResumeTimeout = 10 * time.Second
+	pipingServer.MaxBodySize = 8
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	senderReq, err := http.NewRequest("POST", url+"/mypath", senderBodyReader)
+	if err != nil {
+		t.Fatal(t)
+	}
+	senderRes, err := http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	resumeToken := senderRes.Header.Get("X-Piping-Resume-Token")
+	assert.Assert(t, resumeToken != "")
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("hello")); err != nil {
+			t.Error(t)
+		}
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.StatusCode, 200)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(t)
+	}
+	// Disconnect the sender halfway
+	senderBodyWriter.CloseWithError(errors.New("disconnected"))
+
+	// Ask the offset
+	for {
+		req, err := http.NewRequest("POST", url+"/mypath", nil)
+		if err != nil {
+			t.Fatal(t)
+		}
+		req.Header.Set("Content-Range", "bytes */*")
+		req.Header.Set("X-Piping-Resume-Token", resumeToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(t)
+		}
+		if res.StatusCode == 200 {
+			assert.Equal(t, res.Header.Get("Upload-Offset"), "5")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The range exceeds the limit
+	req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Range", "bytes 5-9/*")
+	req.Header.Set("X-Piping-Resume-Token", resumeToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 413)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The body should be <= 8 bytes on '/mypath', but 10 bytes.\n")
+
+	// The chunked body exceeds the limit
+	req, err = http.NewRequest("POST", url+"/mypath", io.MultiReader(strings.NewReader("world")))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Range", "bytes 5-7/*")
+	req.Header.Set("X-Piping-Resume-Token", resumeToken)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Assert(t, strings.HasSuffix(readerToString(t, res.Body), "[ERROR] The body exceeds the limit of 3 bytes.\n"))
+	rest, _ := io.ReadAll(receiverRes.Body)
+	assert.Assert(t, len(buf)+len(rest) <= 8)
+}
+
+func TestResumeReceiving(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ResumeTimeout = 10 * time.Second
+	pipingServer.ReplayBufferSize = 1024
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	senderReq, err := http.NewRequest("POST", url+"/mypath", senderBodyReader)
+	if err != nil {
+		t.Fatal(t)
+	}
+	senderReq.ContentLength = 10
+	senderRes, err := http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("hello")); err != nil {
+			t.Error(t)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	receiverReq, err := http.NewRequestWithContext(ctx, "GET", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.DefaultClient.Do(receiverReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.StatusCode, 200)
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(t)
+	}
+	// Disconnect the receiver halfway
+	cancel()
+	for {
+		pi, _ := pipingServer.pathToPipe.Load("/mypath")
+		pi.mu.Lock()
+		receiverCtx := pi.transfer.slots[0].receiver.req.Context()
+		pi.mu.Unlock()
+		if receiverCtx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("world")); err != nil {
+			t.Error(t)
+		}
+		senderBodyWriter.Close()
+	}()
+
+	for {
+		req, err := http.NewRequest("GET", url+"/mypath", nil)
+		if err != nil {
+			t.Fatal(t)
+		}
+		req.Header.Set("Range", "bytes=3-")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(t)
+		}
+		if res.StatusCode == 206 {
+			assert.Equal(t, res.Header.Get("Content-Range"), "bytes 3-9/10")
+			assert.Equal(t, res.Header.Get("Content-Length"), "7")
+			assert.Equal(t, string(buf)+readerToString(t, res.Body), "helloworld")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, strings.HasSuffix(readerToString(t, senderRes.Body), "[INFO] Sent successfully!\n"))
+}
+
+func TestResumeReceivingTrailers(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ResumeTimeout = 10 * time.Second
+	pipingServer.ReplayBufferSize = 1024
+	pipingServer.DigestAlgorithm = "sha-256"
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	senderReq, err := http.NewRequest("POST", url+"/mypath", senderBodyReader)
+	if err != nil {
+		t.Fatal(t)
+	}
+	senderReq.ContentLength = 10
+	senderRes, err := http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("hello")); err != nil {
+			t.Error(t)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	receiverReq, err := http.NewRequestWithContext(ctx, "GET", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.DefaultClient.Do(receiverReq)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.StatusCode, 200)
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(t)
+	}
+	// Disconnect the receiver halfway
+	cancel()
+	for {
+		pi, _ := pipingServer.pathToPipe.Load("/mypath")
+		pi.mu.Lock()
+		receiverCtx := pi.transfer.slots[0].receiver.req.Context()
+		pi.mu.Unlock()
+		if receiverCtx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		if _, err := senderBodyWriter.Write([]byte("world")); err != nil {
+			t.Error(t)
+		}
+		senderBodyWriter.Close()
+	}()
+
+	for {
+		req, err := http.NewRequest("GET", url+"/mypath", nil)
+		if err != nil {
+			t.Fatal(t)
+		}
+		req.Header.Set("Range", "bytes=3-")
+		req.Header.Set("TE", "trailers")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(t)
+		}
+		if res.StatusCode == 206 {
+			assert.Equal(t, res.Header.Get("Content-Range"), "bytes 3-9/10")
+			// NOTE: The declared trailers are moved from the header to res.Trailer
+			_, declared := res.Trailer["Repr-Digest"]
+			assert.Assert(t, declared)
+			// NOTE: The response is chunked to have the trailer
+			assert.Equal(t, res.ContentLength, int64(-1))
+			assert.Equal(t, string(buf)+readerToString(t, res.Body), "helloworld")
+			assert.Equal(t, res.Trailer.Get("Repr-Digest"), sha256ContentDigest("helloworld"))
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, strings.HasSuffix(readerToString(t, senderRes.Body), "[INFO] Sent successfully!\n"))
+}
+
+// startSuspendedReceiving starts the transfer on the path and waits until the receiver is disconnected and suspended
+func startSuspendedReceiving(t *testing.T, pipingServer *PipingServer, url string, senderCtx context.Context) (senderRes *http.Response) {
+	senderBodyReader, senderBodyWriter := io.Pipe()
+	t.Cleanup(func() { senderBodyWriter.Close() })
+	senderReq, err := http.NewRequestWithContext(senderCtx, "POST", url+"/mypath", senderBodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderReq.ContentLength = 10
+	senderRes, err = http.DefaultClient.Do(senderReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go senderBodyWriter.Write([]byte("hello"))
+	ctx, cancel := context.WithCancel(context.Background())
+	receiverReq, err := http.NewRequestWithContext(ctx, "GET", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverRes, err := http.DefaultClient.Do(receiverReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(receiverRes.Body, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for {
+		pi, _ := pipingServer.pathToPipe.Load("/mypath")
+		pi.mu.Lock()
+		receiverCtx := pi.transfer.slots[0].receiver.req.Context()
+		pi.mu.Unlock()
+		if receiverCtx.Err() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go senderBodyWriter.Write([]byte("world"))
+	for {
+		pi, _ := pipingServer.pathToPipe.Load("/mypath")
+		pi.mu.Lock()
+		isSuspended := pi.transfer.slots[0].isSuspended
+		pi.mu.Unlock()
+		if isSuspended {
+			return senderRes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSuspendedReceivingIsCanceled(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ResumeTimeout = time.Minute
+	pipingServer.ReplayBufferSize = 1024
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderRes := startSuspendedReceiving(t, pipingServer, url, context.Background())
+	assert.Assert(t, pipingServer.cancelPipe(pipingServer.pipeStatuses()[0].ID))
+	assert.Assert(t, strings.HasSuffix(readerToString(t, senderRes.Body), "[ERROR] The pipe was canceled by the administrator.\n"))
+
+	// NOTE: The path is released without waiting for ResumeTimeout after the sender is disconnected
+	senderCtx, cancelSender := context.WithCancel(context.Background())
+	startSuspendedReceiving(t, pipingServer, url, senderCtx)
+	cancelSender()
+	for {
+		if _, ok := pipingServer.pathToPipe.Load("/mypath"); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, senderRes.Body)
+	res, err := http.Post(url+"/metrics", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+
+	res, err = http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	body := readerToString(t, res.Body)
+	assert.Assert(t, strings.Contains(body, "piping_server_active_pipes 0\n"))
+	assert.Assert(t, strings.Contains(body, "piping_server_transferred_bytes_total 5\n"))
+	assert.Assert(t, strings.Contains(body, "piping_server_transfer_duration_seconds_count 1\n"))
+	assert.Assert(t, strings.Contains(body, `piping_server_rejected_requests_total{reason="reserved_path"} 1`+"\n"))
+	assert.Assert(t, strings.Contains(body, `piping_server_requests_total{protocol="HTTP/1.1"} 4`+"\n"))
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStructuredLog(t *testing.T) {
+	logBuffer := new(lockedBuffer)
+	pipingServer := NewServer(log.New(logBuffer, "", 0))
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, senderRes.Body)
+	logs := logBuffer.String()
+	assert.Assert(t, strings.Contains(logs, "sender connected path=/mypath"))
+	assert.Assert(t, strings.Contains(logs, "receiver connected path=/mypath"))
+	assert.Assert(t, strings.Contains(logs, "transfer completed path=/mypath bytes=5"))
+}
+
+func TestSenderAuth(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.SenderAuth = NewAuth()
+	pipingServer.SenderAuth.AddToken("ci", "mytoken")
+	// password: "mypassword"
+	if err := pipingServer.SenderAuth.AddUser("myuser", "{SHA}kd/Z3bQZiv/FwZTNjObTOP3kcOI="); err != nil {
+		t.Fatal(err)
+	}
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 401)
+	assert.DeepEqual(t, res.Header.Values("WWW-Authenticate"), []string{`Basic realm="Piping Server"`, `Bearer realm="Piping Server"`})
+
+	req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Authorization", "Bearer wrongtoken")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 401)
+
+	// Reserved paths should be public
+	res, err = http.Get(url + "/version")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+
+	for _, setAuth := range []func(req *http.Request){
+		func(req *http.Request) { req.Header.Set("Authorization", "Bearer mytoken") },
+		func(req *http.Request) { req.SetBasicAuth("myuser", "mypassword") },
+	} {
+		req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(t)
+		}
+		setAuth(req)
+		senderRes, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(t)
+		}
+		assert.Equal(t, senderRes.StatusCode, 200)
+		// Receivers do not need authentication
+		receiverRes, err := http.Get(url + "/mypath")
+		if err != nil {
+			t.Fatal(t)
+		}
+		assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+		readerToString(t, senderRes.Body)
+	}
+}
+
+func TestReceiverAuth(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ReceiverAuth = NewAuth()
+	pipingServer.ReceiverAuth.AddToken("reader", "mytoken")
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, res.Header.Get("WWW-Authenticate"), `Bearer realm="Piping Server"`)
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "*")
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tokens"), []byte("ci:citoken\nother:othertoken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policyJson := `{
+  "tokens_file": "tokens",
+  "rules": [
+    {"path": "/ci/**", "methods": ["POST", "PUT"], "identities": ["ci"]},
+    {"path": "/ci/**", "methods": ["GET"]},
+    {"path": "/public/**", "max_receivers": 2, "max_body_size": 10},
+    {"path": "/**", "deny": true}
+  ]
+}`
+	if err := os.WriteFile(filepath.Join(dir, "policy.json"), []byte(policyJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	policy, err := LoadPolicyFile(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipingServer.Policy = policy
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] POST on '/mypath' is denied.\n")
+
+	res, err = http.Post(url+"/ci/build", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 401)
+
+	req, err := http.NewRequest("POST", url+"/ci/build", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Authorization", "Bearer othertoken")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] 'other' is not allowed to POST on '/ci/build'.\n")
+
+	req, err = http.NewRequest("POST", url+"/ci/build", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Authorization", "Bearer citoken")
+	senderRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	// Receivers on /ci/** do not need authentication
+	receiverRes, err := http.Get(url + "/ci/build")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, senderRes.Body)
+
+	res, err = http.Get(url + "/public/mypath?n=3")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] n should be <= 2 on '/public/mypath', but n = 3.\n")
+
+	res, err = http.Post(url+"/public/mypath", "text/plain", strings.NewReader("hello, world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 413)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The body should be <= 10 bytes on '/public/mypath', but 12 bytes.\n")
+}
+
+func TestPolicyMaxBodySizeWhileStreaming(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.Policy = &Policy{Rules: []PolicyRule{{Path: "/**", MaxBodySize: 10}}}
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	// NOTE: The body has no Content-Length
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello, world"))
+		pw.Close()
+	}()
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", pr)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	// The receiver should be aborted
+	_, err = io.ReadAll(receiverRes.Body)
+	assert.Assert(t, err != nil)
+	senderRes := <-senderResCh
+	assert.Assert(t, strings.HasSuffix(readerToString(t, senderRes.Body), "[ERROR] The body exceeds the limit of 10 bytes.\n"))
+}
+
+func TestTransferRateLimit(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.TransferRateLimit = 100000
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	for _, path := range []string{"/mypath", "/mypath?rate=50000"} {
+		body := strings.Repeat("a", 200000)
+		senderResCh := make(chan *http.Response, 1)
+		go func() {
+			senderRes, err := http.Post(url+path, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				close(senderResCh)
+				return
+			}
+			senderResCh <- senderRes
+		}()
+		start := time.Now()
+		receiverRes, err := http.Get(url + "/mypath")
+		if err != nil {
+			t.Fatal(t)
+		}
+		assert.Equal(t, readerToString(t, receiverRes.Body), body)
+		elapsed := time.Since(start)
+		readerToString(t, (<-senderResCh).Body)
+		// NOTE: The first bytes are sent immediately as a burst
+		if path == "/mypath" {
+			assert.Assert(t, elapsed >= 900*time.Millisecond, "elapsed: %s", elapsed)
+		} else {
+			assert.Assert(t, elapsed >= 2900*time.Millisecond, "elapsed: %s", elapsed)
+		}
+	}
+}
+
+// transferConcurrently transfers the body on the paths at the same time and returns the elapsed time
+func transferConcurrently(t *testing.T, url string, paths []string, body string) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(2)
+		go func(path string) {
+			defer wg.Done()
+			senderRes, err := http.Post(url+path, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			readerToString(t, senderRes.Body)
+		}(path)
+		go func(path string) {
+			defer wg.Done()
+			receiverRes, err := http.Get(url + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			assert.Equal(t, readerToString(t, receiverRes.Body), body)
+		}(path)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestRateLimit(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.RateLimit = 100000
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	// NOTE: Each transfer alone takes 0.5 seconds after the first burst, but the limit is shared by the transfers
+	elapsed := transferConcurrently(t, url, []string{"/mypath1", "/mypath2"}, strings.Repeat("a", 150000))
+	assert.Assert(t, elapsed >= 1900*time.Millisecond, "elapsed: %s", elapsed)
+}
+
+func TestIPRateLimit(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.IPRateLimit = 100000
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	// NOTE: The senders have the same IP address
+	elapsed := transferConcurrently(t, url, []string{"/mypath1", "/mypath2"}, strings.Repeat("a", 150000))
+	assert.Assert(t, elapsed >= 1900*time.Millisecond, "elapsed: %s", elapsed)
+	// The limiter of the IP address is removed after the transfers finish
+	pipingServer.rateLimiters.mu.Lock()
+	defer pipingServer.rateLimiters.mu.Unlock()
+	assert.Equal(t, len(pipingServer.rateLimiters.ipToLimiter), 0)
+}
+
+func TestSenderProgress(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.TransferRateLimit = 100000
+	pipingServer.ProgressInterval = 100 * time.Millisecond
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	body := strings.Repeat("a", 200000)
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath?progress=1", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), body)
+	lines := strings.Split(strings.TrimSuffix(readerToString(t, (<-senderResCh).Body), "\n"), "\n")
+	var progressLines []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "[INFO] Sent ") && line != "[INFO] Sent successfully!" {
+			progressLines = append(progressLines, line)
+		}
+	}
+	assert.Assert(t, len(progressLines) >= 3, "lines: %v", lines)
+	assert.Assert(t, strings.Contains(progressLines[0], " of 195.3 KiB ("), progressLines[0])
+	assert.Assert(t, strings.Contains(progressLines[0], "ETA "), progressLines[0])
+	assert.Assert(t, strings.HasPrefix(lines[len(lines)-2], "[INFO] Sent 195.3 KiB of 195.3 KiB ("), lines[len(lines)-2])
+	assert.Equal(t, lines[len(lines)-1], "[INFO] Sent successfully!")
+}
+
+func TestSenderProgressWithServerSentEvents(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		senderRes, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	senderRes := <-senderResCh
+	assert.Equal(t, senderRes.Header.Get("Content-Type"), "text/event-stream")
+	events := strings.Split(strings.TrimSuffix(readerToString(t, senderRes.Body), "\n\n"), "\n\n")
+	assert.DeepEqual(t, events[:3], []string{
+		"event: info\ndata: {\"message\":\"Waiting for 1 receiver(s)...\"}",
+		"event: info\ndata: {\"message\":\"A receiver was connected.\"}",
+		"event: info\ndata: {\"message\":\"Start sending to 1 receiver(s)!\"}",
+	})
+	assert.Assert(t, strings.HasPrefix(events[len(events)-2], "event: progress\ndata: {\"bytes\":5,\"total\":5,"), events[len(events)-2])
+	assert.Equal(t, events[len(events)-1], "event: info\ndata: {\"message\":\"Sent successfully!\"}")
+}
+
+func TestRejectInvalidRate(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath?rate=abc", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] Invalid \"rate\" query parameter\n")
+}
+
+func TestMaxBodySize(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.MaxBodySize = 10
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello, world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 413)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The body should be <= 10 bytes on '/mypath', but 12 bytes.\n")
+}
+
+func TestIPDailyQuota(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "quota.json")
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.IPDailyQuota = 10
+	pipingServer.QuotaSnapshotPath = snapshotPath
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, (<-senderResCh).Body)
+
+	// Rejected up front by Content-Length
+	res, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello!"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 429)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The daily quota of 10 bytes has been exceeded.\n")
+
+	// Aborted while streaming without Content-Length
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello, world"))
+		pw.Close()
+	}()
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", pr)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err = http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	_, err = io.ReadAll(receiverRes.Body)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, strings.HasSuffix(readerToString(t, (<-senderResCh).Body), "[ERROR] The daily quota of 10 bytes has been exceeded.\n"))
+
+	// The usage should be restored from the snapshot
+	restoredServer := NewServer(log.New(io.Discard, "", 0))
+	restoredServer.IPDailyQuota = 10
+	restoredServer.QuotaSnapshotPath = snapshotPath
+	if err := restoredServer.LoadQuotaSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	server2, url2 := servePipingServer(t, restoredServer)
+	defer server2.Shutdown(context.Background())
+	res, err = http.Post(url2+"/mypath", "text/plain", strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 429)
+}
+
+func TestCredentialDailyQuota(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.CredentialDailyQuota = 10
+	pipingServer.SenderAuth = NewAuth()
+	pipingServer.SenderAuth.AddToken("ci", "mytoken1")
+	pipingServer.SenderAuth.AddToken("ci", "mytoken2")
+	pipingServer.SenderAuth.AddToken("dev", "mytoken3")
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	post := func(token string, body string) *http.Response {
+		req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderResCh <- post("mytoken1", "hello")
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, (<-senderResCh).Body)
+
+	// Another token of the same identity shares the quota
+	res := post("mytoken2", "hello!")
+	assert.Equal(t, res.StatusCode, 429)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The daily quota of 10 bytes has been exceeded.\n")
+
+	// Another identity has its own quota
+	go func() {
+		senderResCh <- post("mytoken3", "hello!")
+	}()
+	receiverRes, err = http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello!")
+	senderRes := <-senderResCh
+	assert.Equal(t, senderRes.StatusCode, 200)
+	readerToString(t, senderRes.Body)
+}
+
+func TestLoadQuotaSnapshotWithoutMaps(t *testing.T) {
+	day := time.Now().UTC().Format(time.DateOnly)
+	for _, snapshot := range []string{
+		`{"day": "` + day + `", "ips": null, "identities": null}`,
+		`{"day": "` + day + `"}`,
+	} {
+		snapshotPath := filepath.Join(t.TempDir(), "quota.json")
+		if err := os.WriteFile(snapshotPath, []byte(snapshot), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pipingServer := NewServer(log.New(io.Discard, "", 0))
+		pipingServer.IPDailyQuota = 10
+		pipingServer.CredentialDailyQuota = 10
+		pipingServer.QuotaSnapshotPath = snapshotPath
+		if err := pipingServer.LoadQuotaSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		allowed, err := pipingServer.chargeQuota("127.0.0.1", "ci", 5)
+		assert.NilError(t, err)
+		assert.Equal(t, allowed, 5)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	pr, pw := io.Pipe()
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", pr)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	go func() {
+		pw.Write([]byte("hello"))
+	}()
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	// NOTE: A sender and a receiver waiting for a transfer are released
+	waitingSenderResCh := make(chan string, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/waiting-sender", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			close(waitingSenderResCh)
+			return
+		}
+		waitingSenderResCh <- readerToString(t, senderRes.Body)
+	}()
+	waitingReceiverResCh := make(chan *http.Response, 1)
+	go func() {
+		receiverRes, err := http.Get(url + "/waiting-receiver")
+		if err != nil {
+			t.Error(err)
+			close(waitingReceiverResCh)
+			return
+		}
+		waitingReceiverResCh <- receiverRes
+	}()
+	for len(pipingServer.pipeStatuses()) != 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shutdownErrCh := make(chan error, 1)
+	go func() {
+		shutdownErrCh <- pipingServer.Shutdown(context.Background())
+	}()
+	// Wait for shutting down
+	for !pipingServer.isShuttingDown.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	res, err := http.Post(url+"/mypath2", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 503)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] Piping Server is shutting down. Please retry later.\n")
+	assert.Equal(t, <-waitingSenderResCh, "[INFO] Waiting for 1 receiver(s)...\n[ERROR] Piping Server is shutting down. Please retry later.\n")
+	waitingReceiverRes := <-waitingReceiverResCh
+	assert.Equal(t, waitingReceiverRes.StatusCode, 503)
+	assert.Equal(t, readerToString(t, waitingReceiverRes.Body), "[ERROR] Piping Server is shutting down. Please retry later.\n")
+
+	// The in-flight transfer should finish
+	pw.Write([]byte(", world"))
+	pw.Close()
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello, world")
+	readerToString(t, (<-senderResCh).Body)
+	assert.NilError(t, <-shutdownErrCh)
+}
+
+func TestServeHTTPWithPathPrefix(t *testing.T) {
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		PathPrefix: "/piping",
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/piping/", pipingServer)
+	mux.Handle("/piping", pipingServer)
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Shutdown(context.Background())
+	url := "http://" + ln.Addr().String()
+
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/piping/mypath", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	receiverRes, err := http.Get(url + "/piping/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, (<-senderResCh).Body)
+	_, ok := pipingServer.pathToPipe.Load("/mypath")
+	assert.Assert(t, !ok)
+
+	res, err := http.Get(url + "/piping/help")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Assert(t, strings.Contains(readerToString(t, res.Body), fmt.Sprintf("curl %s/piping/mypath", url)))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.Get(url + "/piping")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 301)
+	assert.Equal(t, res.Header.Get("Location"), "/piping/")
+}
+
+func TestConfig(t *testing.T) {
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler:         newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		AllowedMethods:     []string{"GET", "HEAD", "OPTIONS"},
+		CORSAllowedOrigins: []string{"https://example.com"},
+		ReservedPathHandlers: map[string]http.Handler{
+			"/": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("my top page"))
+			}),
+			"/help": nil,
+		},
+	})
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Get(url + "/")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, res.Body), "my top page")
+
+	res, err = http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 405)
+
+	req, err := http.NewRequest("OPTIONS", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Origin", "https://example.com")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "https://example.com")
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Methods"), "GET, HEAD, OPTIONS")
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Origin"), "")
+
+	// "/help" is released to be used as a normal path
+	res, err = http.Get(url + "/help?n=0")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+}
+
+type recordingHooks struct {
+	NopHooks
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	h.events = append(h.events, event)
+	h.mu.Unlock()
+}
+
+func (h *recordingHooks) Authorize(req *http.Request, role Role) error {
+	if req.URL.Path == "/forbidden" {
+		return errors.New("You are not allowed.")
+	}
+	return nil
+}
+
+func (h *recordingHooks) OnSenderConnected(req *http.Request) {
+	h.record("sender connected: " + req.URL.Path)
+}
+
+func (h *recordingHooks) OnReceiverConnected(req *http.Request) {
+	h.record("receiver connected: " + req.URL.Path)
+}
+
+func (h *recordingHooks) OnTransferStart(info TransferInfo) {
+	h.record(fmt.Sprintf("transfer started: %s %d", info.Path, len(info.ReceiverAddrs)))
+}
+
+func (h *recordingHooks) OnTransferProgress(info TransferInfo, bytes int64) {
+	h.record(fmt.Sprintf("transfer progress: %s %d", info.Path, bytes))
+}
+
+func (h *recordingHooks) OnTransferEnd(info TransferInfo, bytes int64, duration time.Duration, err error) {
+	h.record(fmt.Sprintf("transfer ended: %s %d %v", info.Path, bytes, err))
+}
+
+func TestHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		Hooks:      hooks,
+	})
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Get(url + "/forbidden")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 403)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] You are not allowed.\n")
+
+	senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, readerToString(t, receiverRes.Body), "hello")
+	readerToString(t, senderRes.Body)
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	assert.DeepEqual(t, hooks.events, []string{
+		"sender connected: /mypath",
+		"receiver connected: /mypath",
+		"transfer started: /mypath 1",
+		"transfer progress: /mypath 5",
+		"transfer ended: /mypath 5 <nil>",
+	})
+}
+
+func TestCluster(t *testing.T) {
+	testCluster(t, "")
+}
+
+func TestClusterWithPathPrefix(t *testing.T) {
+	testCluster(t, "/piping")
+}
+
+// testCluster transfers on paths owned by various nodes of a cluster of 3 nodes under the path prefix
+func testCluster(t *testing.T, pathPrefix string) {
+	var listeners []net.Listener
+	var urls []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+		urls = append(urls, "http://"+ln.Addr().String())
+	}
+	for i, ln := range listeners {
+		registry, err := NewClusterRegistry(urls[i], urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipingServer := NewServerWithConfig(Config{
+			LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+			PathPrefix: pathPrefix,
+			Registry:   registry,
+		})
+		server := &http.Server{Handler: pipingServer}
+		go server.Serve(ln)
+		defer server.Shutdown(context.Background())
+	}
+
+	for i := 0; i < 10; i++ {
+		path := fmt.Sprintf("/mypath%d", i)
+		senderURL := urls[i%3]
+		receiverURL := urls[(i+1)%3]
+		// NOTE: The body has no Content-Length
+		pr, pw := io.Pipe()
+		senderResCh := make(chan *http.Response, 1)
+		go func() {
+			senderRes, err := http.Post(senderURL+pathPrefix+path, "text/plain", pr)
+			if err != nil {
+				t.Error(err)
+				close(senderResCh)
+				return
+			}
+			senderResCh <- senderRes
+		}()
+		go func() {
+			pw.Write([]byte("hello, "))
+			pw.Write([]byte(path))
+			pw.Close()
+		}()
+		receiverRes, err := http.Get(receiverURL + pathPrefix + path)
+		if err != nil {
+			t.Fatal(t)
+		}
+		assert.Equal(t, readerToString(t, receiverRes.Body), "hello, "+path)
+		assert.Assert(t, strings.HasSuffix(readerToString(t, (<-senderResCh).Body), "[INFO] Sent successfully!\n"))
+	}
+}
+
+func TestClusterTrustsForwardedRequestsOnlyFromPeers(t *testing.T) {
+	registry, err := NewClusterRegistry("http://192.0.2.1:8080", []string{"http://192.0.2.1:8080", "http://192.0.2.2:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		Registry:   registry,
+	})
+
+	req := httptest.NewRequest("GET", "/mypath", nil)
+	req.RemoteAddr = "192.0.2.2:54321"
+	req.Header.Set("X-Piping-Forwarded", "1")
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	pipingServer.trustForwardedRequest(req)
+	assert.Equal(t, req.Header.Get("X-Piping-Forwarded"), "1")
+	assert.Equal(t, req.RemoteAddr, "203.0.113.5")
+	assert.Equal(t, remoteIP(req), "203.0.113.5")
+
+	// NOTE: A client can not skip proxying or pretend to be another client
+	req = httptest.NewRequest("GET", "/mypath", nil)
+	req.RemoteAddr = "198.51.100.7:54321"
+	req.Header.Set("X-Piping-Forwarded", "1")
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	pipingServer.trustForwardedRequest(req)
+	assert.Equal(t, req.Header.Get("X-Piping-Forwarded"), "")
+	assert.Equal(t, remoteIP(req), "198.51.100.7")
+}
+
+func TestClusterRegistryCachesPeerIPs(t *testing.T) {
+	registry, err := NewClusterRegistry("http://localhost:8080", []string{"http://localhost:8080", "http://192.0.2.2:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, registry.IsPeer("127.0.0.1"))
+	assert.Assert(t, registry.IsPeer("192.0.2.2"))
+	assert.Assert(t, !registry.IsPeer("198.51.100.7"))
+
+	// The cached addresses are used until they expire
+	registry.mu.Lock()
+	registry.peerIPs = nil
+	registry.mu.Unlock()
+	assert.Assert(t, !registry.IsPeer("192.0.2.2"))
+	registry.mu.Lock()
+	registry.peerIPsExpiresAt = time.Now()
+	registry.mu.Unlock()
+	assert.Assert(t, registry.IsPeer("192.0.2.2"))
+}
+
+// decryptPipingStream decrypts the stream of "X-Piping-Encryption: aes-256-gcm"
+func decryptPipingStream(t *testing.T, encrypted []byte, passphrase string) string {
+	assert.Equal(t, string(encrypted[:8]), "PIPINGE1")
+	salt, noncePrefix := encrypted[8:24], encrypted[24:28]
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, 100000, 32, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := encrypted[28:]
+	var plain []byte
+	for counter := uint64(0); ; counter++ {
+		length := binary.BigEndian.Uint32(rest)
+		chunk := rest[4 : 4+length]
+		rest = rest[4+length:]
+		nonce := binary.BigEndian.AppendUint64(append([]byte(nil), noncePrefix...), counter)
+		isLast := len(rest) == 0
+		additionalData := []byte{0}
+		if isLast {
+			additionalData[0] = 1
+		}
+		plain, err = aead.Open(plain, nonce, chunk, additionalData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLast {
+			return string(plain)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	req, err := http.NewRequest("POST", url+"/mypath?passphrase=mypass", strings.NewReader("hello, world"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Piping-Encryption", "aes-256-gcm")
+	senderRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, receiverRes.Header.Get("X-Piping-Encryption"), "aes-256-gcm")
+	assert.Equal(t, receiverRes.Header.Get("Content-Type"), "application/octet-stream")
+	assert.Equal(t, receiverRes.Header.Get("Access-Control-Expose-Headers"), "X-Piping-Encryption")
+	encrypted, err := io.ReadAll(receiverRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, decryptPipingStream(t, encrypted, "mypass"), "hello, world")
+	readerToString(t, senderRes.Body)
+
+	req, err = http.NewRequest("POST", url+"/mypath", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(t)
+	}
+	req.Header.Set("X-Piping-Encryption", "aes-256-gcm")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(t)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] \"passphrase\" query parameter is required for encryption.\n")
+}
+
+type adminPipes struct {
+	Pipes []struct {
+		ID              string `json:"id"`
+		Path            string `json:"path"`
+		SenderConnected bool   `json:"sender_connected"`
+		Transferring    bool   `json:"transferring"`
+		Bytes           int64  `json:"bytes"`
+		TotalLength     int64  `json:"total_length"`
+		Sender          *struct {
+			Protocol string `json:"protocol"`
+		} `json:"sender"`
+		Receivers []struct {
+			Protocol string `json:"protocol"`
+		} `json:"receivers"`
+	} `json:"pipes"`
+}
+
+func TestAdminHandler(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.AdminAuth = NewAuth()
+	pipingServer.AdminAuth.AddToken("admin", "admintoken")
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminServer := &http.Server{Handler: pipingServer.AdminHandler()}
+	go adminServer.Serve(ln)
+	defer adminServer.Shutdown(context.Background())
+	adminURL := "http://" + ln.Addr().String()
+	adminRequest := func(method string, path string) *http.Response {
+		req, err := http.NewRequest(method, adminURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer admintoken")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	getPipes := func() adminPipes {
+		res := adminRequest("GET", "/pipes")
+		assert.Equal(t, res.StatusCode, 200)
+		var pipes adminPipes
+		if err := json.NewDecoder(res.Body).Decode(&pipes); err != nil {
+			t.Fatal(err)
+		}
+		return pipes
+	}
+
+	res, err := http.Get(adminURL + "/pipes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 401)
+	assert.Equal(t, len(getPipes().Pipes), 0)
+
+	bodyReader, bodyWriter := io.Pipe()
+	senderResCh := make(chan *http.Response, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", bodyReader)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- senderRes
+	}()
+	go bodyWriter.Write([]byte("hello"))
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderRes := <-senderResCh
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(receiverRes.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	pipes := getPipes()
+	assert.Equal(t, len(pipes.Pipes), 1)
+	pipe := pipes.Pipes[0]
+	assert.Equal(t, pipe.ID, pipingServer.pipeID("/mypath"))
+	// NOTE: The ID is not guessable from the path
+	hash := sha256.Sum256([]byte("/mypath"))
+	assert.Assert(t, pipe.ID != hex.EncodeToString(hash[:]))
+	assert.Equal(t, pipe.Path, "/mypath")
+	assert.Assert(t, pipe.SenderConnected)
+	assert.Assert(t, pipe.Transferring)
+	assert.Equal(t, pipe.Bytes, int64(5))
+	assert.Equal(t, pipe.TotalLength, int64(-1))
+	assert.Equal(t, pipe.Sender.Protocol, "HTTP/1.1")
+	assert.Equal(t, len(pipe.Receivers), 1)
+
+	res = adminRequest("DELETE", "/pipes/"+pipe.ID)
+	assert.Equal(t, res.StatusCode, 204)
+	_, err = io.ReadAll(receiverRes.Body)
+	assert.Assert(t, err != nil)
+	senderBody := readerToString(t, senderRes.Body)
+	assert.Assert(t, strings.HasSuffix(senderBody, "[ERROR] The pipe was canceled by the administrator.\n"), senderBody)
+	bodyWriter.Close()
+	assert.Equal(t, len(getPipes().Pipes), 0)
+	res = adminRequest("DELETE", "/pipes/"+pipe.ID)
+	assert.Equal(t, res.StatusCode, 404)
+}
+
+func TestAdminHandlerCancelWaitingReceiver(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.AdminHashPaths = true
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	receiverResCh := make(chan *http.Response, 1)
+	go func() {
+		receiverRes, err := http.Get(url + "/mypath")
+		if err != nil {
+			t.Error(err)
+			close(receiverResCh)
+			return
+		}
+		receiverResCh <- receiverRes
+	}()
+	var pipes []pipeStatus
+	for len(pipes) == 0 || len(pipes[0].Receivers) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		pipes = pipingServer.pipeStatuses()
+	}
+	assert.Equal(t, pipes[0].Path, "")
+	assert.Assert(t, pipingServer.cancelPipe(pipes[0].ID))
+	receiverRes := <-receiverResCh
+	assert.Equal(t, receiverRes.StatusCode, 410)
+	assert.Equal(t, readerToString(t, receiverRes.Body), "[ERROR] The pipe was canceled by the administrator.\n")
+}
+
+func gzipString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// getWithAcceptEncoding gets without decompression by net/http
+func getWithAcceptEncoding(t *testing.T, url string, acceptEncoding string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestContentEncodingPassThrough(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	body := gzipString(t, "hello, world")
+	go func() {
+		req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+		senderRes, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, senderRes.Body)
+	}()
+	res := getWithAcceptEncoding(t, url+"/mypath", "identity")
+	assert.Equal(t, res.Header.Get("Content-Encoding"), "gzip")
+	assert.Equal(t, readerToString(t, res.Body), body)
+}
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.NegotiateContentEncoding = true
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	body := strings.Repeat("hello, world\n", 1000)
+	for _, senderEncoding := range []string{"", "gzip"} {
+		go func(senderEncoding string) {
+			senderBody := body
+			if senderEncoding == "gzip" {
+				senderBody = gzipString(t, body)
+			}
+			req, err := http.NewRequest("POST", url+"/mypath?n=3", strings.NewReader(senderBody))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Encoding", senderEncoding)
+			senderRes, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, senderRes.Body)
+		}(senderEncoding)
+		resCh := make(chan *http.Response, 3)
+		for _, acceptEncoding := range []string{"zstd, gzip", "gzip;q=1, zstd;q=0.5", "identity"} {
+			go func(acceptEncoding string) {
+				resCh <- getWithAcceptEncoding(t, url+"/mypath?n=3", acceptEncoding)
+			}(acceptEncoding)
+		}
+		var encodings []string
+		for i := 0; i < 3; i++ {
+			res := <-resCh
+			assert.Equal(t, res.Header.Get("Vary"), "Accept-Encoding")
+			encodings = append(encodings, res.Header.Get("Content-Encoding"))
+			var reader io.Reader = res.Body
+			switch res.Header.Get("Content-Encoding") {
+			case "zstd":
+				zstdReader, err := zstd.NewReader(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zstdReader.Close()
+				reader = zstdReader
+			case "gzip":
+				gzipReader, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = gzipReader
+				// NOTE: The body of the sender is passed through
+				if senderEncoding == "gzip" {
+					assert.Equal(t, res.Header.Get("Content-Length"), strconv.Itoa(len(gzipString(t, body))))
+				}
+			case "":
+				if senderEncoding == "" {
+					assert.Equal(t, res.Header.Get("Content-Length"), strconv.Itoa(len(body)))
+				}
+			default:
+				t.Fatalf("unexpected Content-Encoding: %s", res.Header.Get("Content-Encoding"))
+			}
+			assert.Equal(t, readerToString(t, reader), body)
+		}
+		sort.Strings(encodings)
+		if senderEncoding == "" {
+			assert.DeepEqual(t, encodings, []string{"", "gzip", "zstd"})
+		} else {
+			assert.DeepEqual(t, encodings, []string{"", "gzip", "gzip"})
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.ForwardedHeaders = []string{"Last-Modified", "x-meta-*", "Cookie"}
+	pipingServer.BlockedHeaders = []string{"X-Meta-Secret"}
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	header := http.Header{}
+	header.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	header.Set("X-Meta-Build-Id", "1234")
+	header.Set("X-Meta-Secret", "secret")
+	header.Set("Cookie", "session=secret")
+	header.Set("X-Other", "other")
+
+	var multipartBody bytes.Buffer
+	multipartWriter := multipart.NewWriter(&multipartBody)
+	partHeader := textproto.MIMEHeader(header.Clone())
+	partHeader.Set("Content-Type", "text/plain")
+	part, err := multipartWriter.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("hello"))
+	multipartWriter.Close()
+
+	for _, isMultipart := range []bool{false, true} {
+		go func(isMultipart bool) {
+			req, err := http.NewRequest("POST", url+"/mypath", strings.NewReader("hello"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if isMultipart {
+				req, err = http.NewRequest("POST", url+"/mypath", bytes.NewReader(multipartBody.Bytes()))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+			} else {
+				req.Header = header.Clone()
+			}
+			senderRes, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, senderRes.Body)
+		}(isMultipart)
+		res, err := http.Get(url + "/mypath")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, readerToString(t, res.Body), "hello")
+		assert.Equal(t, res.Header.Get("Last-Modified"), "Wed, 21 Oct 2015 07:28:00 GMT")
+		assert.Equal(t, res.Header.Get("X-Meta-Build-Id"), "1234")
+		assert.Equal(t, res.Header.Get("X-Meta-Secret"), "")
+		assert.Equal(t, res.Header.Get("Cookie"), "")
+		assert.Equal(t, res.Header.Get("X-Other"), "")
+		assert.Equal(t, res.Header.Get("Access-Control-Expose-Headers"), "Last-Modified, X-Meta-Build-Id")
+	}
+
+	req, err := http.NewRequest("OPTIONS", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Access-Control-Request-Headers", "content-type, x-meta-build-id, x-meta-secret, cookie")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.Header.Get("Access-Control-Allow-Headers"), "Content-Type, Content-Disposition, Content-Encoding, X-Piping, X-Piping-Encryption, Last-Modified, X-Meta-Build-Id")
+}
+
+func sha256ContentDigest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestDigestAndTrailers(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.DigestAlgorithm = "sha-256"
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderResCh := make(chan string, 1)
+	go func() {
+		// NOTE: The body without Content-Length is chunked to have trailers
+		req, err := http.NewRequest("POST", url+"/mypath", io.NopCloser(strings.NewReader("hello")))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("Content-Digest", sha256ContentDigest("hello"))
+		req.Trailer = http.Header{"X-Checksum": {"abc"}, "Authorization": {"secret"}}
+		senderRes, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		senderResCh <- readerToString(t, senderRes.Body)
+	}()
+	req, err := http.NewRequest("GET", url+"/mypath", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("TE", "trailers")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, res.Body), "hello")
+	assert.Equal(t, res.Trailer.Get("Repr-Digest"), sha256ContentDigest("hello"))
+	assert.Equal(t, res.Trailer.Get("X-Checksum"), "abc")
+	assert.Equal(t, res.Trailer.Get("Authorization"), "")
+	assert.Equal(t, res.Trailer.Get("X-Piping-Digest-Status"), "valid")
+	sum := sha256.Sum256([]byte("hello"))
+	assert.Assert(t, strings.Contains(<-senderResCh, "[INFO] sha256="+hex.EncodeToString(sum[:])+"\n[INFO] Sent successfully!\n"))
+}
+
+func TestContentDigestMismatch(t *testing.T) {
+	hooks := &recordingHooks{}
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		Hooks:      hooks,
+	})
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderResCh := make(chan string, 1)
+	go func() {
+		req, err := http.NewRequest("POST", url+"/mypath?n=2", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("Content-Digest", sha256ContentDigest("world"))
+		senderRes, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		senderResCh <- readerToString(t, senderRes.Body)
+	}()
+	var wg sync.WaitGroup
+	var trailerRes *http.Response
+	var trailerBody string
+	var plainErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		req, err := http.NewRequest("GET", url+"/mypath?n=2", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header.Set("TE", "trailers")
+		if trailerRes, err = http.DefaultClient.Do(req); err != nil {
+			t.Error(err)
+			return
+		}
+		trailerBody = readerToString(t, trailerRes.Body)
+	}()
+	go func() {
+		defer wg.Done()
+		res, err := http.Get(url + "/mypath?n=2")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, plainErr = io.ReadAll(res.Body)
+	}()
+	wg.Wait()
+	if trailerRes == nil {
+		t.FailNow()
+	}
+	assert.Equal(t, trailerBody, "hello")
+	assert.Equal(t, trailerRes.Trailer.Get("X-Piping-Digest-Status"), "invalid")
+	// NOTE: The receiver not accepting trailers is aborted
+	assert.ErrorIs(t, plainErr, io.ErrUnexpectedEOF)
+	assert.Assert(t, strings.Contains(<-senderResCh, "[ERROR] The body does not match Content-Digest (sha-256).\n"))
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	assert.Equal(t, hooks.events[len(hooks.events)-1], "transfer ended: /mypath 5 the body does not match Content-Digest")
+}
+
+func TestStoreAndForward(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.StoreDir = t.TempDir()
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	req, err := http.NewRequest("POST", url+"/mypath?store=1h", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Piping", "mymetadata")
+	senderRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	assert.Assert(t, strings.HasPrefix(readerToString(t, senderRes.Body), "[INFO] Stored 5 bytes on '/mypath' until "))
+
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	assert.Equal(t, readerToString(t, res.Body), "hello")
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/plain")
+	assert.Equal(t, res.Header.Get("Content-Length"), "5")
+	assert.Equal(t, res.Header.Get("X-Piping"), "mymetadata")
+	// NOTE: The stored body is deleted after a receiver gets it
+	entries, err := os.ReadDir(pipingServer.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestStoreRateLimit(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.StoreDir = t.TempDir()
+	pipingServer.TransferRateLimit = 100000
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	body := strings.Repeat("a", 200000)
+	start := time.Now()
+	senderRes, err := http.Post(url+"/mypath?store=1h", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	readerToString(t, senderRes.Body)
+	elapsed := time.Since(start)
+	// NOTE: The first bytes are stored immediately as a burst
+	assert.Assert(t, elapsed >= 900*time.Millisecond, "elapsed: %s", elapsed)
+
+	start = time.Now()
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, res.Body), body)
+	elapsed = time.Since(start)
+	assert.Assert(t, elapsed >= 900*time.Millisecond, "elapsed: %s", elapsed)
+}
+
+func TestStoreDigest(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.StoreDir = t.TempDir()
+	pipingServer.DigestAlgorithm = "sha-256"
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	req, err := http.NewRequest("POST", url+"/mypath?store=1h", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Digest", sha256ContentDigest("hello"))
+	senderRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	assert.Assert(t, strings.HasPrefix(readerToString(t, senderRes.Body), fmt.Sprintf("[INFO] sha256=%x\n[INFO] Stored 5 bytes", sha256.Sum256([]byte("hello")))))
+
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, res.Body), "hello")
+	assert.Equal(t, res.Header.Get("Repr-Digest"), sha256ContentDigest("hello"))
+	assert.Equal(t, res.Header.Get("X-Piping-Digest-Status"), "valid")
+	assert.Equal(t, res.Header.Get("Access-Control-Expose-Headers"), "Repr-Digest, X-Piping-Digest-Status")
+
+	// The body does not match Content-Digest
+	req, err = http.NewRequest("POST", url+"/mypath?store=1h", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Digest", sha256ContentDigest("world"))
+	senderRes, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, senderRes.StatusCode, 400)
+	assert.Equal(t, readerToString(t, senderRes.Body), "[ERROR] The body does not match Content-Digest (sha-256).\n")
+	assert.Assert(t, !pipingServer.isBodyStored("/mypath"))
+}
+
+func TestStoredBodyExpires(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.StoreDir = t.TempDir()
+	pipingServer.WaitTimeout = 100 * time.Millisecond
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderRes, err := http.Post(url+"/mypath?store=100ms", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, senderRes.StatusCode, 200)
+	time.Sleep(300 * time.Millisecond)
+	entries, err := os.ReadDir(pipingServer.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(entries), 0)
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 408)
+}
+
+func TestStoreErrors(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+	res, err := http.Post(url+"/mypath?store=1h", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] Store-and-forward is not enabled on this server.\n")
+
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.StoreDir = t.TempDir()
+	pipingServer.StoreMaxTTL = time.Hour
+	pipingServer.StoreMaxSize = 5
+	server2, url2 := servePipingServer(t, pipingServer)
+	defer server2.Shutdown(context.Background())
+	for _, c := range []struct {
+		query      string
+		body       io.Reader
+		statusCode int
+		message    string
+	}{
+		{query: "store=abc", body: strings.NewReader("hello"), statusCode: 400, message: "[ERROR] Invalid \"store\" query parameter (e.g. store=1h)\n"},
+		{query: "store=2h", body: strings.NewReader("hello"), statusCode: 400, message: "[ERROR] store should <= 1h0m0s, but store = 2h0m0s.\n"},
+		{query: "store=1h&n=2", body: strings.NewReader("hello"), statusCode: 400, message: "[ERROR] A stored body can be sent to only one receiver.\n"},
+		{query: "store=1h", body: strings.NewReader("hello!"), statusCode: 413, message: "[ERROR] A stored body should be <= 5 bytes, but 6 bytes.\n"},
+		// NOTE: without Content-Length
+		{query: "store=1h", body: io.NopCloser(strings.NewReader("hello!")), statusCode: 413, message: "[ERROR] A stored body should be <= 5 bytes.\n"},
+		{query: "store=1h", body: strings.NewReader("hello"), statusCode: 200},
+		{query: "store=1h", body: strings.NewReader("hello"), statusCode: 400, message: "[ERROR] A body has already been stored on '/mypath'.\n"},
+	} {
+		res, err := http.Post(url2+"/mypath?"+c.query, "text/plain", c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, res.StatusCode, c.statusCode)
+		if c.message != "" {
+			assert.Equal(t, readerToString(t, res.Body), c.message)
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	pipingServer.BroadcastReplaySize = 1024
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	// NOTE: A receiver can wait for a broadcast
+	receiver1ResCh := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(url + "/mypath?mode=broadcast")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		receiver1ResCh <- res
+	}()
+	// Wait for the receiver to join
+	time.Sleep(100 * time.Millisecond)
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequest("POST", url+"/mypath?mode=broadcast", bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	senderRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderResReader := bufio.NewReader(senderRes.Body)
+	line, err := senderResReader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "[INFO] Broadcasting on '/mypath'. Receivers can join at any time.\n")
+
+	receiver1Res := <-receiver1ResCh
+	assert.Equal(t, receiver1Res.Header.Get("Content-Type"), "text/plain")
+	receiver1Reader := bufio.NewReader(receiver1Res.Body)
+	bodyWriter.Write([]byte("hello\n"))
+	line, err = receiver1Reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "hello\n")
+
+	// NOTE: A late receiver gets the last bytes and the rest of the stream
+	receiver2Res, err := http.Get(url + "/mypath?replay=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver2Reader := bufio.NewReader(receiver2Res.Body)
+	line, err = receiver2Reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "lo\n")
+	bodyWriter.Write([]byte("world\n"))
+	bodyWriter.Close()
+	assert.Equal(t, readerToString(t, receiver1Reader), "world\n")
+	assert.Equal(t, readerToString(t, receiver2Reader), "world\n")
+	assert.Equal(t, readerToString(t, senderResReader), "[INFO] Sent successfully!\n")
+
+	// NOTE: The path can be used for a new transfer after the broadcast
+	go func() {
+		senderRes, err := http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, senderRes.Body)
+	}()
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, res.Body), "hello")
+}
+
+func TestBroadcastDropsSlowReceiver(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	bodyReader, bodyWriter := io.Pipe()
+	senderResCh := make(chan string, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath?mode=broadcast", "application/octet-stream", bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		senderResCh <- readerToString(t, senderRes.Body)
+	}()
+	bodyWriter.Write([]byte("a"))
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: The receiver does not read while the sender sends more than the buffers
+	chunk := make([]byte, 1024*1024)
+	for i := 0; i < 64; i++ {
+		bodyWriter.Write(chunk)
+	}
+	bodyWriter.Close()
+	assert.Equal(t, <-senderResCh, "[INFO] Broadcasting on '/mypath'. Receivers can join at any time.\n[INFO] Sent successfully!\n")
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestBroadcastErrors(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	res, err := http.Post(url+"/mypath?mode=unknown", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] mode should be broadcast, but mode = unknown.\n")
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go func() {
+		senderRes, err := http.Post(url+"/mypath?mode=broadcast", "text/plain", bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, senderRes.Body)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	res, err = http.Post(url+"/mypath", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] '/mypath' is used for a broadcast.\n")
+}
+
+func TestBroadcastHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		Hooks:      hooks,
+	})
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	receiverResCh := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(url + "/mypath?mode=broadcast")
+		if err != nil {
+			t.Error(err)
+			close(receiverResCh)
+			return
+		}
+		receiverResCh <- res
+	}()
+	for pipes := pipingServer.pipeStatuses(); len(pipes) == 0 || len(pipes[0].Receivers) == 0; pipes = pipingServer.pipeStatuses() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	senderRes, err := http.Post(url+"/mypath?mode=broadcast", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerToString(t, senderRes.Body)
+	assert.Equal(t, readerToString(t, (<-receiverResCh).Body), "hello")
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	assert.DeepEqual(t, hooks.events, []string{
+		"receiver connected: /mypath",
+		"sender connected: /mypath",
+		"transfer started: /mypath 1",
+		"transfer progress: /mypath 5",
+		"transfer ended: /mypath 5 <nil>",
+	})
+}
+
+func TestBroadcastReceiverLimit(t *testing.T) {
+	server, url := serve(t)
+	defer server.Shutdown(context.Background())
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go func() {
+		senderRes, err := http.Post(url+"/mypath?mode=broadcast&n=1", "text/plain", bodyReader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, senderRes.Body)
+	}()
+	bodyWriter.Write([]byte("a"))
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 200)
+	defer res.Body.Close()
+	res, err = http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res.StatusCode, 400)
+	assert.Equal(t, readerToString(t, res.Body), "[ERROR] The number of receivers has reached limits.\n")
+}
+
+func TestAdminHandlerCancelBroadcast(t *testing.T) {
+	pipingServer := NewServer(log.New(io.Discard, "", 0))
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	senderResCh := make(chan string, 1)
+	go func() {
+		senderRes, err := http.Post(url+"/mypath?mode=broadcast", "text/plain", bodyReader)
+		if err != nil {
+			t.Error(err)
+			close(senderResCh)
+			return
+		}
+		senderResCh <- readerToString(t, senderRes.Body)
+	}()
+	bodyWriter.Write([]byte("a"))
+	receiverRes, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipes := pipingServer.pipeStatuses()
+	assert.Equal(t, len(pipes), 1)
+	assert.Assert(t, pipes[0].Broadcast)
+	assert.Assert(t, pipes[0].Transferring)
+	assert.Equal(t, pipes[0].Path, "/mypath")
+	assert.Equal(t, len(pipes[0].Receivers), 1)
+	assert.Assert(t, pipingServer.cancelPipe(pipes[0].ID))
+	_, err = io.ReadAll(receiverRes.Body)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, <-senderResCh, "[INFO] Broadcasting on '/mypath'. Receivers can join at any time.\n[ERROR] The pipe was canceled by the administrator.\n")
+	assert.Equal(t, len(pipingServer.pipeStatuses()), 0)
+}
+
+func TestStoreHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	pipingServer := NewServerWithConfig(Config{
+		LogHandler: newLogLoggerHandler(log.New(io.Discard, "", 0)),
+		Hooks:      hooks,
+		StoreDir:   t.TempDir(),
+	})
+	server, url := servePipingServer(t, pipingServer)
+	defer server.Shutdown(context.Background())
+
+	senderRes, err := http.Post(url+"/mypath?store=1h", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerToString(t, senderRes.Body)
+	res, err := http.Get(url + "/mypath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, readerToString(t, res.Body), "hello")
+	// NOTE: The hook of the receiver may be called after the response
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		hooks.mu.Lock()
+		nEvents := len(hooks.events)
+		hooks.mu.Unlock()
+		if nEvents == 6 {
+			break
+		}
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	assert.DeepEqual(t, hooks.events, []string{
+		"transfer started: /mypath 0",
+		"transfer progress: /mypath 5",
+		"transfer ended: /mypath 5 <nil>",
+		"transfer started: /mypath 1",
+		"transfer progress: /mypath 5",
+		"transfer ended: /mypath 5 <nil>",
+	})
+}
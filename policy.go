@@ -0,0 +1,173 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+)
+
+// PolicyRule is a rule for paths matched with Path
+type PolicyRule struct {
+	// Path is an exact path, a glob such as "/logs/*.txt" or a prefix such as "/ci/**"
+	Path string `json:"path"`
+	// Methods are methods the rule applies to. Empty means all methods.
+	Methods []string `json:"methods,omitempty"`
+	// Deny rejects requests matched with the rule
+	Deny bool `json:"deny,omitempty"`
+	// Identities are identities of Policy.Auth allowed. "*" allows any authenticated identity. Empty means no authentication.
+	Identities []string `json:"identities,omitempty"`
+	// MaxBodySize is the maximum body size of a sender in bytes. Zero means no limit.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	// MaxReceivers is the maximum number of receivers. Zero means no limit.
+	MaxReceivers int `json:"max_receivers,omitempty"`
+}
+
+// Policy controls access to paths. The first rule matched with the path and the method is applied.
+// Requests matched with no rule are denied.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+	// HtpasswdPath and TokensPath are loaded into Auth by LoadPolicyFile()
+	HtpasswdPath string `json:"htpasswd,omitempty"`
+	TokensPath   string `json:"tokens_file,omitempty"`
+	// Auth authenticates Identities in rules
+	Auth *Auth `json:"-"`
+}
+
+// LoadPolicyFile loads a policy in JSON. Relative paths in the policy are resolved from the directory of the file.
+func LoadPolicyFile(path string) (*Policy, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := new(Policy)
+	if err := json.Unmarshal(bytes, policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	policy.Auth = NewAuth()
+	dir := filepath.Dir(path)
+	if policy.HtpasswdPath != "" {
+		if err := policy.Auth.LoadHtpasswdFile(resolvePath(dir, policy.HtpasswdPath)); err != nil {
+			return nil, err
+		}
+	}
+	if policy.TokensPath != "" {
+		if err := policy.Auth.LoadTokensFile(resolvePath(dir, policy.TokensPath)); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func resolvePath(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func (p *Policy) validate() error {
+	for i, rule := range p.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("rules[%d].path should start with '/' but '%s'", i, rule.Path)
+		}
+		if _, err := pathpkg.Match(strings.TrimSuffix(rule.Path, "/**"), "/"); err != nil {
+			return fmt.Errorf("rules[%d].path is invalid: %w", i, err)
+		}
+		for _, method := range rule.Methods {
+			switch method {
+			case "GET", "POST", "PUT":
+			default:
+				return fmt.Errorf("rules[%d].methods should be GET, POST or PUT but '%s'", i, method)
+			}
+		}
+		if rule.MaxBodySize < 0 {
+			return fmt.Errorf("rules[%d].max_body_size should be >= 0 but %d", i, rule.MaxBodySize)
+		}
+		if rule.MaxReceivers < 0 {
+			return fmt.Errorf("rules[%d].max_receivers should be >= 0 but %d", i, rule.MaxReceivers)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) matches(path string, method string) bool {
+	if len(r.Methods) != 0 {
+		found := false
+		for _, m := range r.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if prefix, ok := strings.CutSuffix(r.Path, "/**"); ok {
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	matched, _ := pathpkg.Match(r.Path, path)
+	return matched
+}
+
+func (r *PolicyRule) allowsIdentity(identity string) bool {
+	for _, id := range r.Identities {
+		if id == "*" || id == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the rule applied to the request or nil
+func (p *Policy) Match(path string, method string) *PolicyRule {
+	for i := range p.Rules {
+		if p.Rules[i].matches(path, method) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// checkPolicy responds an error and returns false if Policy does not allow the request.
+// It returns nil rule if Policy is not set, and the identity if the rule requires a credential.
+func (s *PipingServer) checkPolicy(resWriter http.ResponseWriter, req *http.Request, nReceivers int) (rule *PolicyRule, identity string, ok bool) {
+	if s.Policy == nil {
+		return nil, "", true
+	}
+	path := req.URL.Path
+	rule = s.Policy.Match(path, req.Method)
+	if rule == nil || rule.Deny {
+		s.metrics.observeRejection(rejectReasonForbidden)
+		s.respondError(resWriter, req, 403, fmt.Sprintf("[ERROR] %s on '%s' is denied.\n", req.Method, path))
+		return nil, "", false
+	}
+	if len(rule.Identities) != 0 {
+		auth := s.Policy.Auth
+		if auth == nil {
+			auth = NewAuth()
+		}
+		identity, ok = s.authenticate(auth, resWriter, req)
+		if !ok {
+			return nil, "", false
+		}
+		if !rule.allowsIdentity(identity) {
+			s.metrics.observeRejection(rejectReasonForbidden)
+			s.respondError(resWriter, req, 403, fmt.Sprintf("[ERROR] '%s' is not allowed to %s on '%s'.\n", identity, req.Method, path))
+			return nil, "", false
+		}
+	}
+	if rule.MaxReceivers != 0 && nReceivers > rule.MaxReceivers {
+		s.metrics.observeRejection(rejectReasonForbidden)
+		s.respondError(resWriter, req, 403, fmt.Sprintf("[ERROR] n should be <= %d on '%s', but n = %d.\n", rule.MaxReceivers, path, nReceivers))
+		return nil, "", false
+	}
+	return rule, identity, true
+}
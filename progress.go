@@ -0,0 +1,177 @@
+package piping_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	progressQueryName       = "progress"
+	eventStreamMediaType    = "text/event-stream"
+	defaultProgressInterval = time.Second
+)
+
+// acceptsEventStream returns true if the sender wants the response in Server-Sent Events
+func acceptsEventStream(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), eventStreamMediaType)
+}
+
+// setSenderResponseHeader sets headers of the sender response. It should be called before writing the status.
+func setSenderResponseHeader(header http.Header, req *http.Request) {
+	if acceptsEventStream(req) {
+		header.Set("Content-Type", eventStreamMediaType)
+		header.Set("Cache-Control", "no-cache")
+	}
+}
+
+// newSenderWriter returns the writer of "[INFO] ..." and "[ERROR] ..." lines to the sender
+func newSenderWriter(resWriter http.ResponseWriter, req *http.Request) io.Writer {
+	writer := NewWriteFlusherIfPossible(resWriter)
+	if acceptsEventStream(req) {
+		return &sseWriter{writer: writer}
+	}
+	return writer
+}
+
+// sseWriter converts lines into Server-Sent Events with JSON payloads.
+// "[INFO] ..." is sent as an "info" event and "[ERROR] ..." as an "error" event.
+type sseWriter struct {
+	writer io.Writer
+	// NOTE: a line not terminated yet
+	line []byte
+}
+
+type sseMessage struct {
+	Message string `json:"message"`
+}
+
+func (w *sseWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		line := string(w.line[:i])
+		w.line = w.line[i+1:]
+		event, message := "message", line
+		if strings.HasPrefix(line, "[INFO] ") {
+			event, message = "info", strings.TrimPrefix(line, "[INFO] ")
+		} else if strings.HasPrefix(line, "[ERROR] ") {
+			event, message = "error", strings.TrimPrefix(line, "[ERROR] ")
+		}
+		if err := w.writeEvent(event, sseMessage{Message: message}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (w *sseWriter) writeEvent(event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)))
+	return err
+}
+
+// progressEvent is the payload of a "progress" event
+type progressEvent struct {
+	Bytes int64 `json:"bytes"`
+	// NOTE: omitted if the Content-Length of the sender is unknown
+	Total          *int64  `json:"total,omitempty"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// NOTE: omitted if the Content-Length of the sender is unknown
+	ETASeconds *float64 `json:"eta_seconds,omitempty"`
+}
+
+// senderProgress periodically reports the bytes sent to the sender
+type senderProgress struct {
+	isEnabled bool
+	transfer  *transfer
+	startedAt time.Time
+	// NOTE: bytes sent before the sender of this request
+	startBytes int64
+	// NOTE: nil if disabled not to be selected
+	tickCh <-chan time.Time
+	ticker *time.Ticker
+}
+
+func (s *PipingServer) newSenderProgress(t *transfer, req *http.Request) *senderProgress {
+	progress := &senderProgress{transfer: t}
+	if req.URL.Query().Get(progressQueryName) != "1" && !acceptsEventStream(req) {
+		return progress
+	}
+	interval := s.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	progress.isEnabled = true
+	progress.startedAt = time.Now()
+	progress.startBytes = t.receiverWriter.progress.Load()
+	progress.ticker = time.NewTicker(interval)
+	progress.tickCh = progress.ticker.C
+	return progress
+}
+
+func (p *senderProgress) stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+}
+
+func (p *senderProgress) event() progressEvent {
+	sent := p.transfer.receiverWriter.progress.Load()
+	event := progressEvent{Bytes: sent}
+	if elapsed := time.Since(p.startedAt).Seconds(); elapsed > 0 {
+		event.BytesPerSecond = float64(sent-p.startBytes) / elapsed
+	}
+	if p.transfer.totalLength >= 0 {
+		total := p.transfer.totalLength
+		event.Total = &total
+		if event.BytesPerSecond > 0 {
+			eta := float64(total-sent) / event.BytesPerSecond
+			event.ETASeconds = &eta
+		}
+	}
+	return event
+}
+
+// write writes a progress line or a "progress" event
+func (p *senderProgress) write(writer io.Writer) {
+	event := p.event()
+	if w, ok := writer.(*sseWriter); ok {
+		w.writeEvent("progress", event)
+		return
+	}
+	line := fmt.Sprintf("[INFO] Sent %s", formatBytes(event.Bytes))
+	if event.Total != nil {
+		line += fmt.Sprintf(" of %s", formatBytes(*event.Total))
+	}
+	line += fmt.Sprintf(" (%s/s", formatBytes(int64(event.BytesPerSecond)))
+	if event.ETASeconds != nil {
+		line += fmt.Sprintf(", ETA %s", time.Duration(*event.ETASeconds*float64(time.Second)).Round(time.Second))
+	}
+	writer.Write([]byte(line + ")\n"))
+}
+
+// formatBytes formats bytes in a human-readable form such as "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / unit
+	for _, prefix := range []string{"Ki", "Mi", "Gi", "Ti"} {
+		if value < unit || prefix == "Ti" {
+			return fmt.Sprintf("%.1f %sB", value, prefix)
+		}
+		value /= unit
+	}
+	return ""
+}
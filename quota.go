@@ -0,0 +1,173 @@
+package piping_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quotaExceededError is returned while reading a body exceeding the daily quota
+type quotaExceededError struct {
+	quota int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("The daily quota of %d bytes has been exceeded.", e.quota)
+}
+
+// quotaUsage is bytes sent today by IP addresses and credential identities
+type quotaUsage struct {
+	Day        string           `json:"day"`
+	IPs        map[string]int64 `json:"ips"`
+	Identities map[string]int64 `json:"identities"`
+}
+
+type quotas struct {
+	mu    sync.Mutex
+	usage quotaUsage
+}
+
+func newQuotas() *quotas {
+	return &quotas{usage: quotaUsage{IPs: map[string]int64{}, Identities: map[string]int64{}}}
+}
+
+// resetIfNewDayLocked clears the usage when the day changes in UTC
+func (q *quotas) resetIfNewDayLocked() {
+	day := time.Now().UTC().Format(time.DateOnly)
+	if q.usage.Day != day {
+		q.usage = quotaUsage{Day: day, IPs: map[string]int64{}, Identities: map[string]int64{}}
+	}
+}
+
+// remainingQuotaLocked returns the smallest remaining bytes of the quotas of the sender and the quota.
+// It returns -1 if the sender has no quota.
+func (s *PipingServer) remainingQuotaLocked(ip string, identity string) (remaining int64, quota int64) {
+	remaining = -1
+	if s.IPDailyQuota > 0 {
+		remaining, quota = s.IPDailyQuota-s.quotas.usage.IPs[ip], s.IPDailyQuota
+	}
+	if s.CredentialDailyQuota > 0 && identity != "" {
+		if r := s.CredentialDailyQuota - s.quotas.usage.Identities[identity]; remaining == -1 || r < remaining {
+			remaining, quota = r, s.CredentialDailyQuota
+		}
+	}
+	if quota == 0 {
+		return -1, 0
+	}
+	return max(remaining, 0), quota
+}
+
+// exceededQuota returns the quota exceeded by sending contentLength bytes or 0. contentLength is -1 if unknown.
+func (s *PipingServer) exceededQuota(ip string, identity string, contentLength int64) int64 {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	s.quotas.resetIfNewDayLocked()
+	remaining, quota := s.remainingQuotaLocked(ip, identity)
+	if remaining != -1 && remaining < max(contentLength, 1) {
+		return quota
+	}
+	return 0
+}
+
+// chargeQuota adds n bytes to the usage and returns the bytes allowed to send
+func (s *PipingServer) chargeQuota(ip string, identity string, n int) (int, error) {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	s.quotas.resetIfNewDayLocked()
+	allowed := n
+	var err error
+	remaining, quota := s.remainingQuotaLocked(ip, identity)
+	if remaining != -1 && remaining < int64(n) {
+		allowed = int(remaining)
+		err = &quotaExceededError{quota: quota}
+	}
+	s.quotas.usage.IPs[ip] += int64(allowed)
+	if identity != "" {
+		s.quotas.usage.Identities[identity] += int64(allowed)
+	}
+	return allowed, err
+}
+
+// quotaReader charges bytes read from the sender to the daily quotas
+type quotaReader struct {
+	server   *PipingServer
+	reader   io.Reader
+	ip       string
+	identity string
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		allowed, quotaErr := r.server.chargeQuota(r.ip, r.identity, n)
+		if quotaErr != nil {
+			return allowed, quotaErr
+		}
+	}
+	return n, err
+}
+
+type quotaReadCloser struct {
+	quotaReader
+	closer io.Closer
+}
+
+func (r *quotaReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// LoadQuotaSnapshot loads the usage of daily quotas saved in QuotaSnapshotPath. It does nothing if the file does not exist.
+func (s *PipingServer) LoadQuotaSnapshot() error {
+	bytes, err := os.ReadFile(s.QuotaSnapshotPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var usage quotaUsage
+	if err := json.Unmarshal(bytes, &usage); err != nil {
+		return fmt.Errorf("%s: %w", s.QuotaSnapshotPath, err)
+	}
+	// NOTE: The maps are nil if they are null or missing in the file
+	if usage.IPs == nil {
+		usage.IPs = map[string]int64{}
+	}
+	if usage.Identities == nil {
+		usage.Identities = map[string]int64{}
+	}
+	s.quotas.mu.Lock()
+	s.quotas.usage = usage
+	s.quotas.resetIfNewDayLocked()
+	s.quotas.mu.Unlock()
+	return nil
+}
+
+// saveQuotaSnapshot saves the usage of daily quotas in QuotaSnapshotPath if set
+func (s *PipingServer) saveQuotaSnapshot() {
+	if s.QuotaSnapshotPath == "" {
+		return
+	}
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	bytes, err := json.Marshal(&s.quotas.usage)
+	if err != nil {
+		s.logger.Error("failed to save quota snapshot", "error", err.Error())
+		return
+	}
+	// NOTE: Write to a temporary file and rename it not to leave a broken snapshot
+	tmpPath := filepath.Join(filepath.Dir(s.QuotaSnapshotPath), "."+filepath.Base(s.QuotaSnapshotPath)+".tmp")
+	if err := os.WriteFile(tmpPath, bytes, 0600); err != nil {
+		s.logger.Error("failed to save quota snapshot", "error", err.Error())
+		return
+	}
+	if err := os.Rename(tmpPath, s.QuotaSnapshotPath); err != nil {
+		s.logger.Error("failed to save quota snapshot", "error", err.Error())
+	}
+}
@@ -0,0 +1,154 @@
+package piping_server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NOTE: the maximum bytes read at once not to make bursts
+const maxRateLimitedReadSize = 32 * 1024
+
+// rateLimiter is a token bucket refilled rate bytes per second up to rate bytes
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// reserve takes n tokens and returns the duration to wait until the tokens are available
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// rateLimitedReader reads at the rate of the slowest limiter
+type rateLimitedReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*rateLimiter
+	readSize int
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.readSize {
+		p = p[:r.readSize]
+	}
+	n, err := r.reader.Read(p)
+	var delay time.Duration
+	for _, limiter := range r.limiters {
+		delay = max(delay, limiter.reserve(n))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// ipRateLimiter is shared by transfers from the same IP address
+type ipRateLimiter struct {
+	limiter *rateLimiter
+	nUsers  int
+}
+
+// rateLimiters holds limiters shared by transfers
+type rateLimiters struct {
+	mu          sync.Mutex
+	global      *rateLimiter
+	ipToLimiter map[string]*ipRateLimiter
+}
+
+// getRate parses the "rate" query parameter. It returns 0 if not specified.
+func getRate(req *http.Request) (int64, error) {
+	rateStr := req.URL.Query().Get("rate")
+	if rateStr == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseInt(rateStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("[ERROR] Invalid \"rate\" query parameter\n")
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("[ERROR] rate should > 0, but rate = %d.\n", rate)
+	}
+	return rate, nil
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitReader limits the body read for the request by RateLimit, TransferRateLimit, IPRateLimit and the "rate" query parameter.
+// release should be called after reading.
+func (s *PipingServer) rateLimitReader(req *http.Request, body io.Reader) (reader io.Reader, release func()) {
+	var limiters []*rateLimiter
+	release = func() {}
+	if rate, _ := getRate(req); rate > 0 {
+		limiters = append(limiters, newRateLimiter(rate))
+	}
+	if s.TransferRateLimit > 0 {
+		limiters = append(limiters, newRateLimiter(s.TransferRateLimit))
+	}
+	s.rateLimiters.mu.Lock()
+	if s.RateLimit > 0 {
+		if s.rateLimiters.global == nil {
+			s.rateLimiters.global = newRateLimiter(s.RateLimit)
+		}
+		limiters = append(limiters, s.rateLimiters.global)
+	}
+	if s.IPRateLimit > 0 {
+		ip := remoteIP(req)
+		ipLimiter, ok := s.rateLimiters.ipToLimiter[ip]
+		if !ok {
+			ipLimiter = &ipRateLimiter{limiter: newRateLimiter(s.IPRateLimit)}
+			s.rateLimiters.ipToLimiter[ip] = ipLimiter
+		}
+		ipLimiter.nUsers++
+		limiters = append(limiters, ipLimiter.limiter)
+		release = func() {
+			s.rateLimiters.mu.Lock()
+			ipLimiter.nUsers--
+			if ipLimiter.nUsers == 0 {
+				delete(s.rateLimiters.ipToLimiter, ip)
+			}
+			s.rateLimiters.mu.Unlock()
+		}
+	}
+	s.rateLimiters.mu.Unlock()
+	if len(limiters) == 0 {
+		return body, release
+	}
+	readSize := maxRateLimitedReadSize
+	for _, limiter := range limiters {
+		readSize = min(readSize, max(1, int(limiter.rate)))
+	}
+	return &rateLimitedReader{ctx: req.Context(), reader: body, limiters: limiters, readSize: readSize}, release
+}
@@ -36,10 +36,17 @@ var indexPage = fmt.Sprintf(
 <h3>Step 2: Write your secret path</h3>
 (e.g. "abcd1234", "mysecret.png")<br>
 <input id="secret_path" placeholder="Secret path" size="50"><br>
+<input type="checkbox" id="encryption_mode">: <b>Encrypt with passphrase</b>
+<input id="passphrase" type="password" placeholder="Passphrase"><br>
 <h3>Step 3: Click the send button</h3>
 <button onclick="send()">Send</button><br>
 <progress id="progress_bar" value="0" max="100" style="display: none"></progress><br>
 <div id="message"></div>
+<h3>Receive an encrypted transfer</h3>
+<input id="receive_path" placeholder="Secret path" size="50"><br>
+<input id="receive_passphrase" type="password" placeholder="Passphrase"><br>
+<button onclick="receiveAndDecrypt()">Receive and decrypt</button><br>
+<div id="receive_message"></div>
 <hr>
 <a href="https://piping-ui.org">Piping UI for Web</a><br>
 <a href="%s">Transfer without JavaScript</a><br>
@@ -84,7 +91,14 @@ var indexPage = fmt.Sprintf(
     // Send
     var xhr = new XMLHttpRequest();
     var path = location.href.replace(/\/$/, '') + "/" + window.secret_path.value;
+    // Encrypt in the server with AES-256-GCM
+    if (window.encryption_mode.checked) {
+      path += "?passphrase=" + encodeURIComponent(window.passphrase.value);
+    }
     xhr.open("POST", path, true);
+    if (window.encryption_mode.checked) {
+      xhr.setRequestHeader("X-Piping-Encryption", "aes-256-gcm");
+    }
     // If file has no type
     if (!window.text_mode.checked && body.type === "") {
       xhr.setRequestHeader("Content-Type", "application/octet-stream");
@@ -114,6 +128,108 @@ var indexPage = fmt.Sprintf(
     // Show progress bar
     window.progress_bar.style.removeProperty("display");
   }
+  function concatBytes(a, b) {
+    var c = new Uint8Array(a.length + b.length);
+    c.set(a, 0);
+    c.set(b, a.length);
+    return c;
+  }
+  // Receive and decrypt a transfer sent with "X-Piping-Encryption: aes-256-gcm" (format: see encryption.go)
+  function receiveAndDecrypt() {
+    var path = location.href.replace(/\/$/, '') + "/" + window.receive_path.value;
+    var passphrase = window.receive_passphrase.value;
+    var filename = window.receive_path.value.split("/").pop() || "download";
+    var buffer = new Uint8Array(0);
+    var key = undefined;
+    var noncePrefix;
+    var counter = 0;
+    var finished = false;
+    var plainChunks = [];
+    function deriveKey(salt) {
+      return crypto.subtle.importKey("raw", new TextEncoder().encode(passphrase), "PBKDF2", false, ["deriveKey"]).then(function (baseKey) {
+        return crypto.subtle.deriveKey({name: "PBKDF2", salt: salt, iterations: 100000, hash: "SHA-256"}, baseKey, {name: "AES-GCM", length: 256}, false, ["decrypt"]);
+      });
+    }
+    // Decrypt all complete chunks in the buffer
+    function decryptChunks() {
+      if (key === undefined) {
+        if (buffer.length < 28) {
+          return Promise.resolve();
+        }
+        if (new TextDecoder().decode(buffer.slice(0, 8)) !== "PIPINGE1") {
+          throw new Error("Invalid format");
+        }
+        var salt = buffer.slice(8, 24);
+        noncePrefix = buffer.slice(24, 28);
+        buffer = buffer.slice(28);
+        return deriveKey(salt).then(function (k) {
+          key = k;
+          return decryptChunks();
+        });
+      }
+      if (finished) {
+        if (buffer.length !== 0) {
+          throw new Error("Unexpected data after the last chunk");
+        }
+        return Promise.resolve();
+      }
+      if (buffer.length < 4) {
+        return Promise.resolve();
+      }
+      var length = new DataView(buffer.buffer, buffer.byteOffset).getUint32(0);
+      if (buffer.length < 4 + length) {
+        return Promise.resolve();
+      }
+      var ciphertext = buffer.slice(4, 4 + length);
+      buffer = buffer.slice(4 + length);
+      var nonce = new Uint8Array(12);
+      nonce.set(noncePrefix, 0);
+      new DataView(nonce.buffer).setUint32(4, Math.floor(counter / 4294967296));
+      new DataView(nonce.buffer).setUint32(8, counter >>> 0);
+      counter++;
+      // NOTE: Only the last chunk is empty
+      var isLast = length === 16;
+      return crypto.subtle.decrypt({name: "AES-GCM", iv: nonce, additionalData: new Uint8Array([isLast ? 1 : 0])}, key, ciphertext).then(function (plain) {
+        if (isLast) {
+          finished = true;
+        } else {
+          plainChunks.push(plain);
+        }
+        return decryptChunks();
+      }, function () {
+        throw new Error("Decryption failed. The passphrase may be wrong.");
+      });
+    }
+    window.receive_message.innerText = "Waiting for a sender...";
+    fetch(path).then(function (res) {
+      if (res.headers.get("X-Piping-Encryption") !== "aes-256-gcm") {
+        throw new Error("The transfer is not encrypted");
+      }
+      window.receive_message.innerText = "Receiving...";
+      var reader = res.body.getReader();
+      function read() {
+        return reader.read().then(function (result) {
+          if (result.done) {
+            if (!finished) {
+              throw new Error("The transfer was truncated");
+            }
+            return;
+          }
+          buffer = concatBytes(buffer, result.value);
+          return decryptChunks().then(read);
+        });
+      }
+      return read();
+    }).then(function () {
+      var a = document.createElement("a");
+      a.href = URL.createObjectURL(new Blob(plainChunks));
+      a.download = filename;
+      a.click();
+      window.receive_message.innerText = "Received and decrypted!";
+    }).catch(function (err) {
+      window.receive_message.innerText = "Failed: " + err.message;
+    });
+  }
 </script>
 </body>
 </html>
@@ -182,5 +298,5 @@ func noScriptHtml(path string) string {
   <a href=".">Top page</a><br>
 </body>
 </html>
-`, reservedPathNoScript, noscriptPathQueryParameterName, escapedPath, escapedPath, disabled, disabled)
+`, reservedPathNoScript[1:], noscriptPathQueryParameterName, escapedPath, escapedPath, disabled, disabled)
 }
@@ -0,0 +1,49 @@
+package piping_server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// shutdownPollInterval is the interval to check whether all pipes are closed
+const shutdownPollInterval = 100 * time.Millisecond
+
+const shuttingDownMessage = "[ERROR] Piping Server is shutting down. Please retry later.\n"
+
+var errShuttingDown = errors.New("shutting down")
+
+// Shutdown stops accepting new pipes, releases senders and receivers waiting for transfers and waits for transfers to finish.
+// It returns the context error if the context is done before all pipes are closed.
+func (s *PipingServer) Shutdown(ctx context.Context) error {
+	if s.isShuttingDown.CompareAndSwap(false, true) {
+		close(s.shuttingDownCh)
+	}
+	s.logger.Info("shutting down", "active_pipes", s.metrics.activePipes.Load())
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.metrics.activePipes.Load() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// rejectNewPipeIfShuttingDown responds 503 and returns true if the server is shutting down and no pipe is on the path
+func (s *PipingServer) rejectNewPipeIfShuttingDown(resWriter http.ResponseWriter, req *http.Request, path string) bool {
+	if !s.isShuttingDown.Load() {
+		return false
+	}
+	if _, ok := s.pathToPipe.Load(path); ok {
+		return false
+	}
+	s.metrics.observeRejection(rejectReasonShuttingDown)
+	s.respondError(resWriter, req, 503, shuttingDownMessage)
+	return true
+}
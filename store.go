@@ -0,0 +1,371 @@
+package piping_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storeQueryName = "store"
+	// storeFilePattern is the pattern of files of stored bodies in StoreDir
+	storeFilePattern = "piping-store-*"
+)
+
+var (
+	errStoredBodyTooLarge = errors.New("stored body too large")
+	errStoreFull          = errors.New("store full")
+)
+
+// storedBody is the body of a sender kept in StoreDir until a receiver gets it
+type storedBody struct {
+	// NOTE: set before storedCh is closed
+	filePath  string
+	header    http.Header
+	info      TransferInfo
+	size      int64
+	expiresAt time.Time
+	err       error
+	// NOTE: closed when the body is stored or storing fails
+	storedCh chan struct{}
+}
+
+type store struct {
+	mu         sync.Mutex
+	pathToBody map[string]*storedBody
+	// NOTE: bytes of all stored bodies including bodies being stored
+	totalSize int64
+}
+
+func newStore() *store {
+	return &store{pathToBody: map[string]*storedBody{}}
+}
+
+// getStoreTTL returns the duration in the "store" query parameter
+func (s *PipingServer) getStoreTTL(req *http.Request) (time.Duration, error) {
+	ttl, err := time.ParseDuration(req.URL.Query().Get(storeQueryName))
+	if err != nil {
+		return 0, errors.New("[ERROR] Invalid \"store\" query parameter (e.g. store=1h)\n")
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("[ERROR] store should > 0, but store = %s.\n", ttl)
+	}
+	if s.StoreMaxTTL > 0 && ttl > s.StoreMaxTTL {
+		return 0, fmt.Errorf("[ERROR] store should <= %s, but store = %s.\n", s.StoreMaxTTL, ttl)
+	}
+	return ttl, nil
+}
+
+// PrepareStoreDir creates StoreDir and removes bodies left by a previous process
+func (s *PipingServer) PrepareStoreDir() error {
+	if err := os.MkdirAll(s.StoreDir, 0700); err != nil {
+		return err
+	}
+	filePaths, err := filepath.Glob(filepath.Join(s.StoreDir, storeFilePattern))
+	if err != nil {
+		return err
+	}
+	for _, filePath := range filePaths {
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeWriter writes a body to the file within StoreMaxSize and StoreMaxTotalSize
+type storeWriter struct {
+	server *PipingServer
+	file   *os.File
+	n      int64
+	// NOTE: called with n after each write
+	onWrite func(n int64)
+}
+
+func (w *storeWriter) Write(p []byte) (int, error) {
+	s := w.server
+	if s.StoreMaxSize > 0 && w.n+int64(len(p)) > s.StoreMaxSize {
+		return 0, errStoredBodyTooLarge
+	}
+	s.store.mu.Lock()
+	if s.StoreMaxTotalSize > 0 && s.store.totalSize+int64(len(p)) > s.StoreMaxTotalSize {
+		s.store.mu.Unlock()
+		return 0, errStoreFull
+	}
+	s.store.totalSize += int64(len(p))
+	s.store.mu.Unlock()
+	n, err := w.file.Write(p)
+	w.n += int64(n)
+	s.store.mu.Lock()
+	s.store.totalSize -= int64(len(p) - n)
+	s.store.mu.Unlock()
+	w.onWrite(w.n)
+	return n, err
+}
+
+// removeStoredBody deletes the file of the body and releases its size
+func (s *PipingServer) removeStoredBody(b *storedBody, size int64) {
+	if err := os.Remove(b.filePath); err != nil {
+		s.logger.Error("failed to remove stored body", "file", b.filePath, "error", err.Error())
+	}
+	s.store.mu.Lock()
+	s.store.totalSize -= size
+	s.store.mu.Unlock()
+}
+
+// storeBody spools the body of the sender in StoreDir for a later receiver.
+// It returns false without reading the body if a sender or receivers are already on the path.
+func (s *PipingServer) storeBody(path string, resWriter http.ResponseWriter, req *http.Request, nReceivers int, encryptor *encryptingReader) bool {
+	if s.StoreDir == "" {
+		s.metrics.observeRejection(rejectReasonInvalidStore)
+		s.respondError(resWriter, req, 400, "[ERROR] Store-and-forward is not enabled on this server.\n")
+		return true
+	}
+	ttl, err := s.getStoreTTL(req)
+	if err != nil {
+		s.metrics.observeRejection(rejectReasonInvalidStore)
+		s.respondError(resWriter, req, 400, err.Error())
+		return true
+	}
+	if nReceivers != 1 {
+		s.metrics.observeRejection(rejectReasonInvalidStore)
+		s.respondError(resWriter, req, 400, "[ERROR] A stored body can be sent to only one receiver.\n")
+		return true
+	}
+	if len(req.Header.Values("Content-Range")) != 0 {
+		s.metrics.observeRejection(rejectReasonInvalidStore)
+		s.respondError(resWriter, req, 400, "[ERROR] Content-Range is not supported with \"store\" query parameter.\n")
+		return true
+	}
+	if s.StoreMaxSize > 0 && req.ContentLength > s.StoreMaxSize {
+		s.metrics.observeRejection(rejectReasonBodyTooLarge)
+		s.respondError(resWriter, req, 413, fmt.Sprintf("[ERROR] A stored body should be <= %d bytes, but %d bytes.\n", s.StoreMaxSize, req.ContentLength))
+		return true
+	}
+	if s.rejectNewPipeIfShuttingDown(resWriter, req, path) {
+		return true
+	}
+	b := &storedBody{storedCh: make(chan struct{})}
+	// NOTE: The pipe is checked with the lock because a receiver entering the pipe checks the store with the lock
+	s.store.mu.Lock()
+	// If a receiver is waiting or a sender is connected, the body is not stored
+	if _, ok := s.pathToPipe.Load(path); ok {
+		s.store.mu.Unlock()
+		return false
+	}
+	if _, ok := s.store.pathToBody[path]; ok {
+		s.store.mu.Unlock()
+		s.metrics.observeRejection(rejectReasonDuplicateSender)
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] A body has already been stored on '%s'.\n", path))
+		return true
+	}
+	s.store.pathToBody[path] = b
+	s.store.mu.Unlock()
+	// failStoring releases the path for receivers waiting for the body
+	failStoring := func(err error) {
+		s.store.mu.Lock()
+		delete(s.store.pathToBody, path)
+		s.store.mu.Unlock()
+		b.err = err
+		close(b.storedCh)
+	}
+	file, err := os.CreateTemp(s.StoreDir, storeFilePattern)
+	if err != nil {
+		failStoring(err)
+		s.logger.Error("failed to create stored body", "error", err.Error())
+		s.respondError(resWriter, req, 500, "[ERROR] Failed to store the body.\n")
+		return true
+	}
+	b.filePath = file.Name()
+	b.info = TransferInfo{Path: path, SenderAddr: req.RemoteAddr, ReceiverAddrs: []string{}, TotalLength: req.ContentLength}
+	s.logger.Info("storing body", "path", path, "remote_addr", req.RemoteAddr, "ttl", ttl)
+	s.hooks().OnTransferStart(b.info)
+
+	startedAt := time.Now()
+	transferHeader, transferBody := getSenderTransferHeaderAndBody(req, encryptor)
+	var lastProgressAt time.Time
+	writer := &storeWriter{server: s, file: file, onWrite: func(n int64) { s.reportProgress(b.info, &lastProgressAt, n) }}
+	writers := []io.Writer{writer}
+	bodyDigest := newDigest(s.DigestAlgorithm)
+	if bodyDigest != nil {
+		writers = append(writers, bodyDigest.hash)
+	}
+	contentDigest := parseContentDigest(transferHeader.Get(contentDigestHeaderName))
+	if contentDigest != nil {
+		writers = append(writers, contentDigest.hash)
+	}
+	body, releaseRateLimit := s.rateLimitReader(req, transferBody)
+	_, err = io.Copy(io.MultiWriter(writers...), body)
+	releaseRateLimit()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && contentDigest != nil && !contentDigest.matches() {
+		err = errContentDigestMismatch
+	}
+	s.hooks().OnTransferEnd(b.info, writer.n, time.Since(startedAt), err)
+	if err != nil {
+		failStoring(err)
+		s.removeStoredBody(b, writer.n)
+		s.logger.Warn("storing body failed", "path", path, "bytes", writer.n, "reason", err.Error())
+		var maxBytesErr *http.MaxBytesError
+		var quotaErr *quotaExceededError
+		switch {
+		case errors.Is(err, errStoredBodyTooLarge):
+			s.metrics.observeRejection(rejectReasonBodyTooLarge)
+			s.respondError(resWriter, req, 413, fmt.Sprintf("[ERROR] A stored body should be <= %d bytes.\n", s.StoreMaxSize))
+			return true
+		case errors.Is(err, errStoreFull):
+			s.metrics.observeRejection(rejectReasonStoreFull)
+			s.respondError(resWriter, req, 507, "[ERROR] The store is full. Please retry later.\n")
+			return true
+		case errors.As(err, &maxBytesErr):
+			s.metrics.observeRejection(rejectReasonBodyTooLarge)
+			s.respondError(resWriter, req, 413, fmt.Sprintf("[ERROR] The body exceeds the limit of %d bytes.\n", maxBytesErr.Limit))
+			return true
+		case errors.As(err, &quotaErr):
+			s.metrics.observeRejection(rejectReasonQuotaExceeded)
+			s.respondError(resWriter, req, 429, fmt.Sprintf("[ERROR] %s\n", quotaErr))
+			return true
+		case errors.Is(err, errContentDigestMismatch):
+			s.metrics.observeRejection(rejectReasonDigestMismatch)
+			s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] The body does not match Content-Digest (%s).\n", contentDigest.algorithm))
+			return true
+		}
+		// NOTE: The sender is disconnected
+		return true
+	}
+	b.header = s.newReceiverHeader(req, transferHeader)
+	b.header.Set("Content-Length", strconv.FormatInt(writer.n, 10))
+	// NOTE: The trailers and the digests are known before sending the stored body, so they are sent as headers
+	var exposeHeaders []string
+	for _, name := range s.forwardedTrailerNames(req) {
+		if values := req.Trailer.Values(name); len(values) != 0 {
+			b.header[name] = values
+			exposeHeaders = append(exposeHeaders, name)
+		}
+	}
+	if bodyDigest != nil {
+		b.header.Set(reprDigestHeaderName, bodyDigest.fieldValue())
+		exposeHeaders = append(exposeHeaders, reprDigestHeaderName)
+	}
+	if contentDigest != nil {
+		b.header.Set(digestStatusHeaderName, digestStatusValid)
+		exposeHeaders = append(exposeHeaders, digestStatusHeaderName)
+	}
+	if len(exposeHeaders) != 0 {
+		if value := b.header.Get("Access-Control-Expose-Headers"); value != "" {
+			exposeHeaders = append([]string{value}, exposeHeaders...)
+		}
+		b.header.Set("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
+	}
+	b.size = writer.n
+	b.expiresAt = time.Now().Add(ttl)
+	close(b.storedCh)
+	time.AfterFunc(ttl, func() {
+		s.store.mu.Lock()
+		// If a receiver has got the body
+		if s.store.pathToBody[path] != b {
+			s.store.mu.Unlock()
+			return
+		}
+		delete(s.store.pathToBody, path)
+		s.store.mu.Unlock()
+		s.removeStoredBody(b, b.size)
+		s.logger.Info("stored body expired", "path", path, "bytes", b.size)
+	})
+	s.logger.Info("body stored", "path", path, "bytes", b.size, "expires_at", b.expiresAt)
+	s.setAllowOrigin(resWriter.Header(), req)
+	resWriter.WriteHeader(200)
+	if bodyDigest != nil {
+		resWriter.Write([]byte(bodyDigest.infoLine()))
+	}
+	resWriter.Write([]byte(fmt.Sprintf("[INFO] Stored %d bytes on '%s' until %s.\n", b.size, path, b.expiresAt.UTC().Format(time.RFC3339))))
+	return true
+}
+
+// isBodyStored returns true if a body is stored or being stored on the path
+func (s *PipingServer) isBodyStored(path string) bool {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	_, ok := s.store.pathToBody[path]
+	return ok
+}
+
+// sendStoredBody sends the body stored on the path to the receiver and deletes it.
+// It returns false if no body is stored on the path.
+func (s *PipingServer) sendStoredBody(path string, resWriter http.ResponseWriter, req *http.Request) bool {
+	s.store.mu.Lock()
+	b, ok := s.store.pathToBody[path]
+	s.store.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// Wait for the body being stored
+	select {
+	case <-b.storedCh:
+	case <-req.Context().Done():
+		return true
+	}
+	s.store.mu.Lock()
+	// If storing failed or another receiver has got the body
+	if b.err != nil || s.store.pathToBody[path] != b {
+		s.store.mu.Unlock()
+		return false
+	}
+	delete(s.store.pathToBody, path)
+	s.store.mu.Unlock()
+
+	file, err := os.Open(b.filePath)
+	if err != nil {
+		s.logger.Error("failed to open stored body", "file", b.filePath, "error", err.Error())
+		s.removeStoredBody(b, b.size)
+		s.respondError(resWriter, req, 500, "[ERROR] Failed to read the stored body.\n")
+		return true
+	}
+	defer file.Close()
+	for key, values := range b.header {
+		resWriter.Header()[key] = values
+	}
+	s.setAllowOrigin(resWriter.Header(), req)
+	resWriter.WriteHeader(200)
+	info := TransferInfo{Path: path, SenderAddr: b.info.SenderAddr, ReceiverAddrs: []string{req.RemoteAddr}, TotalLength: b.size}
+	s.hooks().OnTransferStart(info)
+	startedAt := time.Now()
+	body, releaseRateLimit := s.rateLimitReader(req, file)
+	var lastProgressAt time.Time
+	writer := &countingWriter{
+		writer:  resWriter,
+		total:   &s.metrics.transferredBytes,
+		onWrite: func(n int64) { s.reportProgress(info, &lastProgressAt, n) },
+	}
+	_, err = io.Copy(writer, body)
+	releaseRateLimit()
+	n := writer.n
+	s.hooks().OnTransferEnd(info, n, time.Since(startedAt), err)
+	if err != nil {
+		s.store.mu.Lock()
+		_, stored := s.store.pathToBody[path]
+		// Keep the body for another receiver until it expires
+		isKept := !stored && time.Now().Before(b.expiresAt)
+		if isKept {
+			s.store.pathToBody[path] = b
+		}
+		s.store.mu.Unlock()
+		if !isKept {
+			s.removeStoredBody(b, b.size)
+		}
+		s.logger.Warn("sending stored body failed", "path", path, "bytes", n, "reason", err.Error())
+		return true
+	}
+	s.removeStoredBody(b, b.size)
+	s.logger.Info("stored body sent", "path", path, "bytes", n, "remote_addr", req.RemoteAddr)
+	return true
+}
@@ -6,6 +6,15 @@ type SyncMap[K any, V any] struct {
 	inner sync.Map
 }
 
+func (m *SyncMap[K, V]) Load(key K) (value V, ok bool) {
+	valueAny, ok := m.inner.Load(key)
+	if !ok {
+		return
+	}
+	value = valueAny.(V)
+	return
+}
+
 func (m *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
 	actualAny, loaded := m.inner.LoadOrStore(key, value)
 	actual = actualAny.(V)
@@ -15,3 +24,9 @@ func (m *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
 func (m *SyncMap[K, V]) Delete(key K) {
 	m.inner.Delete(key)
 }
+
+func (m *SyncMap[K, V]) Range(f func(key K, value V) bool) {
+	m.inner.Range(func(key, value any) bool {
+		return f(key.(K), value.(V))
+	})
+}
@@ -0,0 +1,656 @@
+package piping_server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// transfer is the state of the transfer from a sender to receivers.
+// It is owned by one sender at a time and handed over to a resuming sender when the sender is disconnected halfway.
+type transfer struct {
+	slots []*receiverSlot
+	// NOTE: writes to all receivers
+	receiverWriter *countingWriter
+	// NOTE: nil if receivers can not resume
+	replayBuffer *replayBuffer
+	// NOTE: headers for receivers resuming with Range
+	receiverHeader http.Header
+	// NOTE: -1 if unknown
+	totalLength            int64
+	receiverDisconnectedCh <-chan struct{}
+	finishedCh             chan struct{}
+	startedAt              time.Time
+	// NOTE: closed when a resuming sender takes over the transfer
+	resumedCh chan struct{}
+	info      TransferInfo
+	// NOTE: An encrypted transfer can not be resumed because the encryption state is not kept
+	isEncrypted bool
+	// NOTE: accessed only by the goroutine copying the body
+	lastProgressAt time.Time
+	// NOTE: nil if Config.DigestAlgorithm is empty
+	digest *digest
+	// NOTE: nil if the sender does not declare Content-Digest
+	contentDigest *expectedDigest
+	// NOTE: trailers of the sender forwarded to the receivers
+	trailerNames  []string
+	senderTrailer http.Header
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+	err    error
+	// NOTE: also counts the total bytes of all transfers
+	total *atomic.Int64
+	// NOTE: called with n after each write
+	onWrite func(n int64)
+	// NOTE: n readable from other goroutines
+	progress atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	w.progress.Store(w.n)
+	w.total.Add(int64(n))
+	if err != nil {
+		w.err = err
+	}
+	if w.onWrite != nil {
+		w.onWrite(w.n)
+	}
+	return n, err
+}
+
+// receiverSlot writes to a receiver. When the receiver is disconnected halfway,
+// it holds the sender until another receiver resumes with Range.
+type receiverSlot struct {
+	// NOTE: replaced under pipe.mu
+	receiver *receiver
+	writer   io.Writer
+	// NOTE: protected by pipe.mu
+	isSuspended bool
+	resumedCh   chan *resumingReceiver
+	// NOTE: not nil if the receiver gets the body in another Content-Encoding
+	coder contentCoder
+}
+
+type resumingReceiver struct {
+	receiver *receiver
+	// NOTE: the first byte position the receiver needs
+	start int64
+}
+
+// replayBuffer keeps the last bytes of the body for receivers resuming with Range
+type replayBuffer struct {
+	buf  []byte
+	size int
+	// NOTE: the number of bytes written so far
+	total int64
+}
+
+func (b *replayBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if len(p) >= b.size {
+		b.buf = append(b.buf[:0], p[len(p)-b.size:]...)
+		return len(p), nil
+	}
+	if overflow := len(b.buf) + len(p) - b.size; overflow > 0 {
+		b.buf = b.buf[:copy(b.buf, b.buf[overflow:])]
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// start returns the first byte position in the buffer
+func (b *replayBuffer) start() int64 {
+	return b.total - int64(len(b.buf))
+}
+
+// resumeTokenHeaderName is the header of the token which a sender needs to resume the transfer
+const resumeTokenHeaderName = "X-Piping-Resume-Token"
+
+// newResumeToken returns a random token given to the sender of a transfer
+func newResumeToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// setResumeTokenHeader sets the resume token in the header of the sender response
+func setResumeTokenHeader(header http.Header, token string) {
+	header.Set(resumeTokenHeaderName, token)
+	header.Add("Access-Control-Expose-Headers", resumeTokenHeaderName)
+}
+
+var contentRangeRegexp = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+|\*)$`)
+
+// parseContentRange parses Content-Range such as "bytes 100-199/200", "bytes 100-199/*" and "bytes */200".
+// start and end are -1 in the unsatisfied form. total is -1 if unknown.
+func parseContentRange(contentRange string) (start int64, end int64, total int64, err error) {
+	matches := contentRangeRegexp.FindStringSubmatch(contentRange)
+	if matches == nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %s", contentRange)
+	}
+	start, end, total = -1, -1, -1
+	if matches[1] != "" {
+		if start, err = strconv.ParseInt(matches[1], 10, 64); err != nil {
+			return
+		}
+		if end, err = strconv.ParseInt(matches[2], 10, 64); err != nil {
+			return
+		}
+		if end < start {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range: %s", contentRange)
+		}
+	}
+	if matches[3] != "*" {
+		if total, err = strconv.ParseInt(matches[3], 10, 64); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// newReceiverHeader returns the response headers for receivers of the sender
+func (s *PipingServer) newReceiverHeader(senderReq *http.Request, transferHeader textproto.MIMEHeader) http.Header {
+	xPipingValues := senderReq.Header.Values("X-Piping")
+	receiverHeader := http.Header{}
+	receiverHeader["Content-Type"] = nil // not to sniff
+	transferHeaderIfExists(receiverHeader, transferHeader, "Content-Type")
+	transferHeaderIfExists(receiverHeader, transferHeader, "Content-Length")
+	transferHeaderIfExists(receiverHeader, transferHeader, "Content-Disposition")
+	transferHeaderIfExists(receiverHeader, transferHeader, "Content-Encoding")
+	if len(xPipingValues) != 0 {
+		receiverHeader["X-Piping"] = xPipingValues
+	}
+	var exposeHeaders []string
+	if len(xPipingValues) != 0 {
+		exposeHeaders = append(exposeHeaders, "X-Piping")
+	}
+	encryption := senderReq.Header.Get(encryptionHeaderName)
+	if encryption != "" {
+		receiverHeader.Set(encryptionHeaderName, encryption)
+		exposeHeaders = append(exposeHeaders, encryptionHeaderName)
+	}
+	exposeHeaders = append(exposeHeaders, s.forwardHeaders(receiverHeader, transferHeader)...)
+	if len(exposeHeaders) != 0 {
+		receiverHeader.Set("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
+	}
+	receiverHeader.Set("X-Robots-Tag", "none")
+	return receiverHeader
+}
+
+// startTransfer writes the response headers to the receivers and returns the transfer
+func (s *PipingServer) startTransfer(path string, pi *pipe, senderReq *http.Request, receivers []*receiver, transferHeader textproto.MIMEHeader) *transfer {
+	receiverHeader := s.newReceiverHeader(senderReq, transferHeader)
+	encryption := receiverHeader.Get(encryptionHeaderName)
+	totalLength := int64(-1)
+	if l, err := strconv.ParseInt(receiverHeader.Get("Content-Length"), 10, 64); err == nil {
+		totalLength = l
+	}
+
+	receiverAddrs := make([]string, len(receivers))
+	for i, rcv := range receivers {
+		receiverAddrs[i] = rcv.req.RemoteAddr
+	}
+	t := &transfer{
+		info:           TransferInfo{Path: path, SenderAddr: senderReq.RemoteAddr, ReceiverAddrs: receiverAddrs, TotalLength: totalLength},
+		receiverHeader: receiverHeader,
+		totalLength:    totalLength,
+		isEncrypted:    encryption != "",
+		finishedCh:     make(chan struct{}),
+		startedAt:      time.Now(),
+	}
+	senderEncoding := normalizeEncoding(receiverHeader.Get("Content-Encoding"))
+	receiverEncodings := make([]string, len(receivers))
+	isConverted := false
+	for i, rcv := range receivers {
+		receiverEncodings[i] = senderEncoding
+		// NOTE: An encrypted body can not be compressed
+		if s.NegotiateContentEncoding && !t.isEncrypted {
+			receiverEncodings[i] = negotiateEncoding(senderEncoding, rcv.req.Header.Get("Accept-Encoding"))
+		}
+		isConverted = isConverted || receiverEncodings[i] != senderEncoding
+	}
+	var writers []io.Writer
+	// NOTE: Receivers can resume only if the length is known because a partial response needs the complete length
+	// NOTE: Receivers of a converted body can not resume because the replay buffer has the body of the sender
+	if s.ResumeTimeout > 0 && s.ReplayBufferSize > 0 && totalLength != -1 && !isConverted {
+		t.replayBuffer = &replayBuffer{size: s.ReplayBufferSize}
+		writers = append(writers, t.replayBuffer)
+	} else {
+		t.receiverDisconnectedCh = watchReceiversDisconnected(receivers, t.finishedCh)
+	}
+	t.trailerNames = s.forwardedTrailerNames(senderReq)
+	if t.digest = newDigest(s.DigestAlgorithm); t.digest != nil {
+		writers = append(writers, t.digest.hash)
+	}
+	if t.contentDigest = parseContentDigest(transferHeader.Get(contentDigestHeaderName)); t.contentDigest != nil {
+		writers = append(writers, t.contentDigest.hash)
+	}
+	for i, rcv := range receivers {
+		slot := &receiverSlot{receiver: rcv, writer: NewWriteFlusherIfPossible(rcv.resWriter)}
+		if receiverEncodings[i] != senderEncoding {
+			slot.coder = newContentCoder(senderEncoding, receiverEncodings[i], slot.writer)
+			slot.writer = slot.coder
+		}
+		s.setReceiverHeader(t, slot, rcv)
+		if slot.coder != nil {
+			setReceiverEncodingHeader(rcv.resWriter.Header(), receiverEncodings[i])
+		}
+		t.slots = append(t.slots, slot)
+		if t.replayBuffer != nil {
+			writers = append(writers, &resumableReceiverWriter{server: s, pipe: pi, transfer: t, slot: slot})
+		} else {
+			writers = append(writers, slot.writer)
+		}
+	}
+	t.receiverWriter = &countingWriter{
+		writer:  io.MultiWriter(writers...),
+		total:   &s.metrics.transferredBytes,
+		onWrite: func(n int64) { s.reportProgress(t.info, &t.lastProgressAt, n) },
+	}
+	pi.mu.Lock()
+	pi.transfer = t
+	pi.mu.Unlock()
+	return t
+}
+
+// setReceiverHeader sets the response headers of the transfer for the receiver of the slot.
+// It is also used for a receiver resuming with Range.
+func (s *PipingServer) setReceiverHeader(t *transfer, slot *receiverSlot, rcv *receiver) {
+	header := rcv.resWriter.Header()
+	for key, values := range t.receiverHeader {
+		header[key] = values
+	}
+	s.setAllowOrigin(header, rcv.req)
+	if s.NegotiateContentEncoding {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	trailerNames := t.trailerNames
+	if t.digest != nil && slot.coder == nil {
+		trailerNames = append(trailerNames[:len(trailerNames):len(trailerNames)], reprDigestHeaderName)
+	}
+	if t.contentDigest != nil {
+		trailerNames = append(trailerNames[:len(trailerNames):len(trailerNames)], digestStatusHeaderName)
+	}
+	if len(trailerNames) != 0 {
+		header.Set("Trailer", strings.Join(trailerNames, ", "))
+		// NOTE: An HTTP/1.1 response is chunked without Content-Length to have trailers.
+		// A chunked response can also be aborted before the end if the body does not match Content-Digest.
+		if rcv.req.ProtoMajor < 2 && (acceptsTrailers(rcv.req) || t.contentDigest != nil) {
+			header.Del("Content-Length")
+		}
+	}
+}
+
+// resumableReceiverWriter writes to the receiver in the slot and waits for a receiver resuming with Range on failure
+type resumableReceiverWriter struct {
+	server   *PipingServer
+	pipe     *pipe
+	transfer *transfer
+	slot     *receiverSlot
+}
+
+func (w *resumableReceiverWriter) Write(p []byte) (int, error) {
+	err := w.slot.receiver.req.Context().Err()
+	if err == nil {
+		if _, err = w.slot.writer.Write(p); err == nil {
+			return len(p), nil
+		}
+	}
+	for {
+		resuming, err := w.waitForReceiverResuming(err)
+		if err != nil {
+			return 0, err
+		}
+		// NOTE: p has already been written in the replay buffer
+		replay := w.transfer.replayBuffer.buf[resuming.start-w.transfer.replayBuffer.start():]
+		if _, err = w.slot.writer.Write(replay); err == nil {
+			return len(p), nil
+		}
+	}
+}
+
+// waitForReceiverResuming waits for a receiver resuming with Range and replaces the receiver in the slot with it
+func (w *resumableReceiverWriter) waitForReceiverResuming(receiverErr error) (*resumingReceiver, error) {
+	s, pi, slot := w.server, w.pipe, w.slot
+	path := slot.receiver.req.URL.Path
+	pi.mu.Lock()
+	slot.isSuspended = true
+	slot.resumedCh = make(chan *resumingReceiver, 1)
+	resumedCh := slot.resumedCh
+	offset := w.transfer.replayBuffer.total
+	// NOTE: The sender writing to the receiver
+	senderReq := pi.senderReq
+	pi.mu.Unlock()
+	s.logger.Info("receiving suspended", "path", path, "offset", offset, "reason", receiverErr.Error(), "remote_addr", slot.receiver.req.RemoteAddr)
+	timer := time.NewTimer(s.ResumeTimeout)
+	defer timer.Stop()
+	var resuming *resumingReceiver
+	select {
+	case resuming = <-resumedCh:
+	// Stop waiting if timed out, the pipe is canceled or the sender is disconnected
+	case <-timer.C:
+	case <-pi.canceledCh:
+	case <-senderReq.Context().Done():
+	}
+	if resuming == nil {
+		pi.mu.Lock()
+		isSuspended := slot.isSuspended
+		slot.isSuspended = false
+		pi.mu.Unlock()
+		if isSuspended {
+			return nil, receiverErr
+		}
+		// NOTE: A receiver is resuming at the same time
+		resuming = <-resumedCh
+	}
+	// Release the previous receiver
+	slot.receiver.transferErr = errReceiverDisconnected
+	close(slot.receiver.doneCh)
+	pi.mu.Lock()
+	slot.receiver = resuming.receiver
+	pi.mu.Unlock()
+	slot.writer = NewWriteFlusherIfPossible(resuming.receiver.resWriter)
+	return resuming, nil
+}
+
+// runTransfer copies the body to the receivers. It returns nil if all the body is sent.
+func (s *PipingServer) runTransfer(path string, pi *pipe, t *transfer, resWriter http.ResponseWriter, req *http.Request, body io.Reader, resWriteFlusher io.Writer) error {
+	body, releaseRateLimit := s.rateLimitReader(req, body)
+	defer releaseRateLimit()
+	copyErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(t.receiverWriter, body)
+		copyErrCh <- err
+	}()
+	progress := s.newSenderProgress(t, req)
+	defer progress.stop()
+	var err error
+	for copying := true; copying; {
+		select {
+		case err = <-copyErrCh:
+			copying = false
+		case <-progress.tickCh:
+			progress.write(resWriteFlusher)
+		case <-t.receiverDisconnectedCh:
+			resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] %s\n", errReceiverDisconnected)))
+			// Interrupt reading the body not to keep the path while the sender sends nothing
+			http.NewResponseController(resWriter).SetReadDeadline(time.Now())
+			// NOTE: The receivers should not be released until copying finishes
+			<-copyErrCh
+			s.finishTransfer(path, pi, t, errReceiverDisconnected)
+			return errReceiverDisconnected
+		case <-req.Context().Done():
+			err = <-copyErrCh
+			copying = false
+		case <-pi.canceledCh:
+			// Interrupt reading the body and writing to the receivers
+			now := time.Now()
+			http.NewResponseController(resWriter).SetReadDeadline(now)
+			pi.mu.Lock()
+			for _, slot := range t.slots {
+				http.NewResponseController(slot.receiver.resWriter).SetWriteDeadline(now)
+			}
+			pi.mu.Unlock()
+			<-copyErrCh
+			resWriteFlusher.Write([]byte("[ERROR] The pipe was canceled by the administrator.\n"))
+			s.finishTransfer(path, pi, t, errPipeCanceled)
+			return errPipeCanceled
+		}
+	}
+	if err == nil {
+		if progress.isEnabled {
+			progress.write(resWriteFlusher)
+		}
+		// NOTE: The trailers of the request are available after the body is read
+		t.senderTrailer = req.Trailer
+		if t.digest != nil {
+			resWriteFlusher.Write([]byte(t.digest.infoLine()))
+		}
+		if t.contentDigest != nil && !t.contentDigest.matches() {
+			resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] The body does not match Content-Digest (%s).\n", t.contentDigest.algorithm)))
+			s.finishTransfer(path, pi, t, errContentDigestMismatch)
+			return errContentDigestMismatch
+		}
+		resWriteFlusher.Write([]byte("[INFO] Sent successfully!\n"))
+		s.finishTransfer(path, pi, t, nil)
+		return nil
+	}
+	if t.receiverWriter.err != nil {
+		resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] %s\n", errReceiverDisconnected)))
+		s.finishTransfer(path, pi, t, errReceiverDisconnected)
+		return errReceiverDisconnected
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] The body exceeds the limit of %d bytes.\n", maxBytesErr.Limit)))
+		s.finishTransfer(path, pi, t, err)
+		return err
+	}
+	var quotaErr *quotaExceededError
+	if errors.As(err, &quotaErr) {
+		resWriteFlusher.Write([]byte(fmt.Sprintf("[ERROR] %s\n", quotaErr)))
+		s.finishTransfer(path, pi, t, err)
+		return err
+	}
+	// If the sender is disconnected halfway
+	if s.ResumeTimeout > 0 && !t.isEncrypted {
+		s.waitForResuming(path, pi, t, err)
+		return err
+	}
+	s.finishTransfer(path, pi, t, err)
+	return err
+}
+
+// waitForResuming keeps the receivers for ResumeTimeout until another sender resumes the transfer
+func (s *PipingServer) waitForResuming(path string, pi *pipe, t *transfer, senderErr error) {
+	pi.mu.Lock()
+	t.resumedCh = make(chan struct{})
+	pi.suspendedTransfer = t
+	pi.senderReq = nil
+	resumedCh := t.resumedCh
+	offset := t.receiverWriter.n
+	pi.mu.Unlock()
+	s.logger.Info("transfer suspended", "path", path, "offset", offset, "reason", senderErr.Error())
+	timer := time.NewTimer(s.ResumeTimeout)
+	defer timer.Stop()
+	err := senderErr
+	select {
+	case <-resumedCh:
+		return
+	case <-timer.C:
+	case <-t.receiverDisconnectedCh:
+		err = errReceiverDisconnected
+	case <-pi.canceledCh:
+		err = errPipeCanceled
+	}
+	pi.mu.Lock()
+	// If another sender has resumed at the same time
+	if pi.suspendedTransfer != t {
+		pi.mu.Unlock()
+		return
+	}
+	pi.suspendedTransfer = nil
+	pi.mu.Unlock()
+	s.finishTransfer(path, pi, t, err)
+}
+
+// finishTransfer releases the receivers and the path
+func (s *PipingServer) finishTransfer(path string, pi *pipe, t *transfer, err error) {
+	close(t.finishedCh)
+	duration := time.Since(t.startedAt)
+	s.metrics.observeTransferDuration(duration)
+	receiverErr := err
+	// NOTE: The receivers get all the body with the trailer telling the mismatch
+	if errors.Is(err, errContentDigestMismatch) {
+		receiverErr = nil
+	}
+	for _, slot := range t.slots {
+		slot.receiver.transferErr = receiverErr
+		if slot.coder != nil {
+			if coderErr := slot.coder.finish(receiverErr); coderErr != nil && receiverErr == nil {
+				slot.receiver.transferErr = coderErr
+			}
+		}
+		if slot.receiver.transferErr == nil {
+			slot.receiver.transferErr = t.setReceiverTrailers(slot)
+		}
+		close(slot.receiver.doneCh)
+	}
+	pi.mu.Lock()
+	s.closeLocked(path, pi)
+	pi.mu.Unlock()
+	s.hooks().OnTransferEnd(t.info, t.receiverWriter.n, duration, err)
+	if err != nil {
+		s.logger.Warn("transfer aborted", "path", path, "bytes", t.receiverWriter.n, "duration", duration, "reason", err.Error())
+		return
+	}
+	s.logger.Info("transfer completed", "path", path, "bytes", t.receiverWriter.n, "duration", duration)
+}
+
+// resumeTransfer takes over the suspended transfer on the path from the byte specified in Content-Range.
+// maxBodySize limits the whole body including the bytes sent before resuming. Zero means no limit.
+// It returns true if the rest of the body is sent.
+func (s *PipingServer) resumeTransfer(path string, resWriter http.ResponseWriter, req *http.Request, maxBodySize int64) bool {
+	start, end, total, err := parseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] %s\n", err))
+		return false
+	}
+	pi := s.getPipe(path)
+	t := pi.suspendedTransfer
+	if t == nil {
+		s.closeIfUnusedLocked(path, pi)
+		pi.mu.Unlock()
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] There is no suspended transfer on '%s'.\n", path))
+		return false
+	}
+	// Only the sender of the transfer can resume it
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(resumeTokenHeaderName)), []byte(pi.resumeToken)) != 1 {
+		pi.mu.Unlock()
+		s.metrics.observeRejection(rejectReasonForbidden)
+		s.respondError(resWriter, req, 403, fmt.Sprintf("[ERROR] %s does not match the sender of the transfer on '%s'.\n", resumeTokenHeaderName, path))
+		return false
+	}
+	offset := t.receiverWriter.n
+	resWriter.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resWriter.Header().Set("Access-Control-Expose-Headers", "Upload-Offset")
+	// If the sender asks the offset by "bytes */<total>"
+	if start == -1 {
+		pi.mu.Unlock()
+		s.respondError(resWriter, req, 200, fmt.Sprintf("[INFO] The transfer on '%s' can be resumed from byte %d.\n", path, offset))
+		return false
+	}
+	if start != offset {
+		pi.mu.Unlock()
+		s.respondError(resWriter, req, 409, fmt.Sprintf("[ERROR] The transfer on '%s' should be resumed from byte %d but %d.\n", path, offset, start))
+		return false
+	}
+	if t.totalLength != -1 && (total != t.totalLength || end != total-1) {
+		pi.mu.Unlock()
+		s.respondError(resWriter, req, 400, fmt.Sprintf("[ERROR] Content-Range should be 'bytes %d-%d/%d'.\n", offset, t.totalLength-1, t.totalLength))
+		return false
+	}
+	if maxBodySize != 0 {
+		size := end + 1
+		if req.ContentLength != -1 && start+req.ContentLength > size {
+			size = start + req.ContentLength
+		}
+		if size > maxBodySize {
+			pi.mu.Unlock()
+			s.metrics.observeRejection(rejectReasonBodyTooLarge)
+			s.respondError(resWriter, req, 413, fmt.Sprintf("[ERROR] The body should be <= %d bytes on '%s', but %d bytes.\n", maxBodySize, path, size))
+			return false
+		}
+		// Abort the transfer when the whole body exceeds the limit without Content-Length
+		req.Body = http.MaxBytesReader(resWriter, req.Body, maxBodySize-offset)
+	}
+	pi.suspendedTransfer = nil
+	pi.senderReq = req
+	close(t.resumedCh)
+	setResumeTokenHeader(resWriter.Header(), pi.resumeToken)
+	pi.mu.Unlock()
+
+	s.writeSenderResponseHeader(resWriter, req, 200)
+
+	resWriteFlusher := newSenderWriter(resWriter, req)
+	resWriteFlusher.Write([]byte(fmt.Sprintf("[INFO] Resuming from byte %d...\n", offset)))
+	return s.runTransfer(path, pi, t, resWriter, req, req.Body, resWriteFlusher) == nil
+}
+
+var rangeRegexp = regexp.MustCompile(`^bytes=(\d+)-$`)
+
+// resumeReceiving hands the receiver over to a suspended receiver slot on the path.
+// It returns false if there is no slot to resume.
+func (s *PipingServer) resumeReceiving(path string, resWriter http.ResponseWriter, req *http.Request) bool {
+	matches := rangeRegexp.FindStringSubmatch(req.Header.Get("Range"))
+	if matches == nil {
+		return false
+	}
+	start, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	pi, ok := s.pathToPipe.Load(path)
+	if !ok {
+		return false
+	}
+	pi.mu.Lock()
+	t := pi.transfer
+	if pi.isClosed || t == nil || t.replayBuffer == nil {
+		pi.mu.Unlock()
+		return false
+	}
+	var slot *receiverSlot
+	for _, sl := range t.slots {
+		if sl.isSuspended {
+			slot = sl
+			break
+		}
+	}
+	if slot == nil {
+		pi.mu.Unlock()
+		return false
+	}
+	bufferStart, total := t.replayBuffer.start(), t.replayBuffer.total
+	if start < bufferStart || start > total {
+		pi.mu.Unlock()
+		resWriter.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", t.totalLength))
+		s.respondError(resWriter, req, 416, fmt.Sprintf("[ERROR] The transfer on '%s' can be resumed from byte %d to %d.\n", path, bufferStart, total))
+		return true
+	}
+	slot.isSuspended = false
+	pi.mu.Unlock()
+
+	rcv := &receiver{resWriter: resWriter, req: req, doneCh: make(chan struct{})}
+	s.setReceiverHeader(t, slot, rcv)
+	// NOTE: Content-Length is removed to have trailers
+	if resWriter.Header().Get("Content-Length") != "" {
+		resWriter.Header().Set("Content-Length", strconv.FormatInt(t.totalLength-start, 10))
+	}
+	resWriter.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, t.totalLength-1, t.totalLength))
+	resWriter.WriteHeader(206)
+	slot.resumedCh <- &resumingReceiver{receiver: rcv, start: start}
+	<-rcv.doneCh
+	if rcv.transferErr != nil {
+		// Abort not to make the receiver regard the partial body as complete
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}